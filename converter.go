@@ -3,6 +3,7 @@ package xml2json
 import (
 	"bytes"
 	"io"
+	"strconv"
 )
 
 // Convert converts the given XML document to JSON
@@ -23,3 +24,62 @@ func Convert(r io.Reader) (*bytes.Buffer, error) {
 
 	return buf, nil
 }
+
+// ConvertToOrderedMap converts the given XML document to an OrderedMap
+func ConvertToOrderedMap(r io.Reader) (OrderedMap, error) {
+	root := &Node{}
+	err := NewDecoder(r).Decode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return ToOrderedMap(root), nil
+}
+
+// DecodeToFlatMap converts the given XML document to a map from dotted paths
+// to text, e.g. "catalog.book.0.title" for the title of the first book.
+// Repeated elements get their index as an extra path element, counted from 0;
+// single ones do not. Attributes appear with their prefix, "catalog.book.0.-id",
+// and the text of elements which also have attributes or children under
+// "#content", "catalog.#content". Elements without text nor children, and null
+// ones, map to "".
+func DecodeToFlatMap(r io.Reader) (map[string]string, error) {
+	root := &Node{}
+	dec := NewDecoder(r)
+	if err := dec.Decode(root); err != nil {
+		return nil, err
+	}
+
+	m := map[string]string{}
+	flatten(m, "", root, dec.contentPrefix+"content")
+	return m, nil
+}
+
+// flatten adds the text of n and its descendants to m, under path
+func flatten(m map[string]string, path string, n *Node, contentKey string) {
+	join := func(label string) string {
+		if path == "" {
+			return label
+		}
+		return path + "." + label
+	}
+
+	if !n.HasChildren() {
+		if path != "" {
+			m[path] = n.Data
+		}
+		return
+	}
+	if n.Data != "" {
+		m[join(contentKey)] = n.Data
+	}
+	for label, children := range n.Children {
+		if len(children) == 1 {
+			flatten(m, join(label), children[0], contentKey)
+			continue
+		}
+		for i, c := range children {
+			flatten(m, join(label)+"."+strconv.Itoa(i), c, contentKey)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package xml2json
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 
@@ -200,3 +201,121 @@ func TestConvertISO(t *testing.T) {
 	// Assertion
 	assert.JSONEq(string(expected), res.String(), "Drumroll")
 }
+
+// TestConvertXsiNil ensures that xsi:nil elements are converted to null
+func TestConvertXsiNil(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<?xml version="1.0" encoding="UTF-8"?>
+	<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+	  <soap:Body>
+	    <name xsi:nil="true"/>
+	    <city xsi:nil="true" code="x">ignored</city>
+	    <zip xsi:nil="false">1234</zip>
+	  </soap:Body>
+	</soap:Envelope>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetRecognizeXsiNil(true)
+	assert.NoError(dec.Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.JSONEq(`{
+	  "Envelope": {
+	    "-soap": "http://schemas.xmlsoap.org/soap/envelope/",
+	    "-xsi": "http://www.w3.org/2001/XMLSchema-instance",
+	    "Body": {
+	      "name": null,
+	      "city": null,
+	      "zip": "1234"
+	    }
+	  }
+	}`, buf.String())
+}
+
+// TestConvertDropNamespaceDeclarations ensures that xmlns attributes can be left out
+func TestConvertDropNamespaceDeclarations(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<?xml version="1.0" encoding="UTF-8"?>
+	<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns="urn:default">
+	  <soap:Body soap:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+	    <price>12</price>
+	  </soap:Body>
+	</soap:Envelope>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetDropNamespaceDeclarations(true)
+	assert.NoError(dec.Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.JSONEq(`{
+	  "Envelope": {
+	    "Body": {
+	      "-encodingStyle": "http://schemas.xmlsoap.org/soap/encoding/",
+	      "price": "12"
+	    }
+	  }
+	}`, buf.String())
+}
+
+// TestConvertAttributeOnlyElements ensures that elements with only attributes are objects
+func TestConvertAttributeOnlyElements(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<?xml version="1.0" encoding="UTF-8"?>
+	<head>
+	  <link href="x" rel="y"/>
+	  <meta charset="utf-8">
+	  </meta>
+	</head>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+	link := root.Children["head"][0].Children["link"][0]
+	assert.True(link.HasChildren())
+	assert.Empty(link.Data)
+
+	res, err := Convert(strings.NewReader(s))
+	assert.NoError(err)
+	assert.JSONEq(`{
+	  "head": {
+	    "link": {"-href": "x", "-rel": "y"},
+	    "meta": {"-charset": "utf-8"}
+	  }
+	}`, res.String())
+}
+
+// TestDecodeToFlatMap ensures that documents are flattened to dotted paths
+func TestDecodeToFlatMap(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<catalog version="2">
+	  intro
+	  <book id="b1"><title>Go</title><tag>a</tag><tag>b</tag></book>
+	  <book id="b2"><title>C</title><empty/></book>
+	  <meta><owner><name>Ann</name></owner></meta>
+	</catalog>`
+
+	m, err := DecodeToFlatMap(strings.NewReader(s))
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"catalog.-version":        "2",
+		"catalog.#content":        "intro",
+		"catalog.book.0.-id":      "b1",
+		"catalog.book.0.title":    "Go",
+		"catalog.book.0.tag.0":    "a",
+		"catalog.book.0.tag.1":    "b",
+		"catalog.book.1.-id":      "b2",
+		"catalog.book.1.title":    "C",
+		"catalog.book.1.empty":    "",
+		"catalog.meta.owner.name": "Ann",
+	}, m)
+
+	_, err = DecodeToFlatMap(strings.NewReader(`<a><b></a>`))
+	assert.Error(err)
+}
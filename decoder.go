@@ -1,8 +1,16 @@
 package xml2json
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"unicode"
 
 	"golang.org/x/net/html/charset"
@@ -11,22 +19,159 @@ import (
 const (
 	attrPrefix    = "-"
 	contentPrefix = "#"
+
+	xsiNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+	xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+)
+
+// Loss is a set of flags telling which information from the XML document
+// could not be kept in the decoded tree. See Decoder.Losses.
+type Loss int
+
+const (
+	// LossComments is set when comments were dropped
+	LossComments Loss = 1 << iota
+	// LossProcInsts is set when processing instructions, other than the XML
+	// declaration, were dropped
+	LossProcInsts
+	// LossDirectives is set when directives, such as a DOCTYPE, were dropped
+	LossDirectives
+	// LossWhitespace is set when whitespace around some text was trimmed
+	LossWhitespace
+	// LossMixedContent is set when an element had both text and child
+	// elements, so the position of the text among the children was lost
+	LossMixedContent
+	// LossOrder is set when elements with the same name were not adjacent to
+	// each other, so grouping them in arrays changed the order of siblings.
+	// Sorted keys are an encoder choice and are not taken into account, see
+	// Encoder.SetSortOrder.
+	LossOrder
+	// LossNamespaces is set when names had a namespace, which is dropped
+	LossNamespaces
+	// LossAttributes is set when attributes beyond the limit of
+	// SetMaxAttributes, or colliding ones as per SetAttributeCollisionPolicy,
+	// were dropped
+	LossAttributes
+)
+
+// ErrTooManyAttributes is returned when an element has more attributes than
+// the limit of SetMaxAttributes, with the AttributesError policy
+var ErrTooManyAttributes = errors.New("xml2json: too many attributes")
+
+// AttributeLimitPolicy is what the decoder does with the elements which have
+// more attributes than the limit of SetMaxAttributes
+type AttributeLimitPolicy int
+
+const (
+	// AttributesError makes the decoding fail with ErrTooManyAttributes, it
+	// is the default
+	AttributesError AttributeLimitPolicy = iota
+	// AttributesDrop keeps the first attributes of the element, up to the
+	// limit, and reports LossAttributes
+	AttributesDrop
+)
+
+// CommentStyle is how the decoder keeps the comments of the document, see
+// Decoder.SetCommentStyle
+type CommentStyle int
+
+const (
+	// CommentsDrop drops the comments and reports LossComments, it is the
+	// default
+	CommentsDrop CommentStyle = iota
+	// CommentsText adds the text of each comment as a child of the element it
+	// is in, labeled with the content prefix and "comment": <a><!-- x --></a>
+	// gives {"a": {"#comment": " x "}}
+	CommentsText
+	// CommentsStructured adds each comment as a child, labeled as with
+	// CommentsText, holding:
+	//   - "text": the text of the comment;
+	//   - "offset": the byte offset of its "<!--" in the input, which is
+	//     approximate when the input is converted from another charset;
+	//   - "previous": the name of the sibling element before it, if any;
+	//   - "next": the name of the sibling element after it, if any.
+	//
+	// <a><b/><!-- x --><c/></a> gives {"a": {"#comment": {"next": "c",
+	// "offset": "7", "previous": "b", "text": " x "}, "b": "", "c": ""}}
+	CommentsStructured
+)
+
+// ErrAttributeCollision is returned with the AttributeCollisionError policy
+// when two attributes of an element have the same name once their namespaces
+// are stripped
+var ErrAttributeCollision = errors.New("xml2json: attribute collision")
+
+// AttributeCollisionPolicy is what the decoder does with the attributes of an
+// element which have the same local name in different namespaces, such as a:x
+// and b:x, and so the same label
+type AttributeCollisionPolicy int
+
+const (
+	// AttributeCollisionArray keeps them all, in document order, so that they
+	// encode as an array, it is the default
+	AttributeCollisionArray AttributeCollisionPolicy = iota
+	// AttributeCollisionKeepFirst keeps the first one and reports
+	// LossAttributes
+	AttributeCollisionKeepFirst
+	// AttributeCollisionKeepLast keeps the value of the last one, at the place
+	// of the first one, and reports LossAttributes
+	AttributeCollisionKeepLast
+	// AttributeCollisionError makes the decoding fail with
+	// ErrAttributeCollision
+	AttributeCollisionError
 )
 
 // A Decoder reads and decodes XML objects from an input stream.
 type Decoder struct {
-	r               io.Reader
-	err             error
-	attributePrefix string
-	contentPrefix   string
+	r                 io.Reader
+	err               error
+	attributePrefix   string
+	contentPrefix     string
+	attrAsContent     map[string]string
+	xsiNil            bool
+	dropXmlns         bool
+	attrDefaults      map[string]map[string]string
+	loss              Loss
+	stripBOM          bool
+	lenient           bool
+	autoClose         []string
+	rawElements       map[string]bool
+	maxAttrs          int
+	attrPolicy        AttributeLimitPolicy
+	normalizeNewlines bool
+	commentStyle      CommentStyle
+	internNames       bool // always set, but for the benchmarks
+	namespaceAsField  bool
+	nsField           string
+	localField        string
+	attrCollision     AttributeCollisionPolicy
+	free              Nodes // nodes of the previous tree, see DecodeInto
 }
 
 type element struct {
-	parent *element
-	n      *Node
-	label  string
+	parent   *element
+	n        *Node
+	label    string
+	depth    int // 1 for the XML root element
+	promoted bool
+	preserve bool // xml:space="preserve" is in effect
+	text     []byte
+	inText   bool // text was read since the last child element
+
+	// Used for structured comments
+	lastLabel string // label of the last child element started
+	comments  Nodes  // comments waiting for the next child element
+
+	// Used to detect losses
+	hasText   bool
+	hasChild  bool
+	lastChild string
+	seen      map[string]bool
 }
 
+// SetAttributePrefix sets the prefix of the labels of attributes, "-" by
+// default. It may be empty, see Encoder.SetKeyClashPolicy for the resulting
+// clashes between attributes and elements.
 func (dec *Decoder) SetAttributePrefix(prefix string) {
 	dec.attributePrefix = prefix
 }
@@ -35,32 +180,368 @@ func (dec *Decoder) SetContentPrefix(prefix string) {
 	dec.contentPrefix = prefix
 }
 
-func (dec *Decoder) DecodeWithCustomPrefixes(root *Node, contentPrefix string, attributePrefix string) error {
-	dec.contentPrefix = contentPrefix
-	dec.attributePrefix = attributePrefix
+// SetAttributeAsContent makes the attribute attrName of the elements named
+// elementName become the content of the element instead of a prefixed key,
+// so that <value v="42"/> decodes like <value>42</value>. The attribute wins
+// over any text in the element; other attributes are kept as usual.
+func (dec *Decoder) SetAttributeAsContent(elementName, attrName string) {
+	if dec.attrAsContent == nil {
+		dec.attrAsContent = map[string]string{}
+	}
+	dec.attrAsContent[elementName] = attrName
+}
+
+// SetRecognizeXsiNil makes elements carrying xsi:nil="true" decode as JSON
+// null, whatever their content. The xsi:nil attribute itself is dropped.
+func (dec *Decoder) SetRecognizeXsiNil(b bool) {
+	dec.xsiNil = b
+}
+
+// SetDropNamespaceDeclarations drops the xmlns and xmlns:* attributes instead
+// of decoding them as attributes. The declarations are still used by the XML
+// parser to resolve the prefixes of element and attribute names.
+func (dec *Decoder) SetDropNamespaceDeclarations(b bool) {
+	dec.dropXmlns = b
+}
+
+// SetAttributeDefaults sets default attribute values for the elements named
+// elementName, as a DTD would declare them: each default is added to the
+// elements which lack that attribute. Defaults behave exactly as if they were
+// in the document and cannot be told apart from explicit attributes.
+func (dec *Decoder) SetAttributeDefaults(elementName string, defaults map[string]string) {
+	if dec.attrDefaults == nil {
+		dec.attrDefaults = map[string]map[string]string{}
+	}
+	dec.attrDefaults[elementName] = defaults
+}
+
+// SetStripInputBOM sets whether a byte order mark at the start of the input is
+// removed, which is the default. A UTF-16 byte order mark also makes the input
+// be converted from UTF-16.
+func (dec *Decoder) SetStripInputBOM(b bool) {
+	dec.stripBOM = b
+}
+
+// SetLenient makes the decoder accept near-XML such as HTML fragments: HTML
+// entities are known, attributes need neither quotes nor values, and the
+// elements of SetAutoClose (HTML void elements like <br> by default) need not
+// be closed. This is best effort: unclosed elements may lead to surprising
+// nesting.
+func (dec *Decoder) SetLenient(b bool) {
+	dec.lenient = b
+}
+
+// SetAutoClose sets the names of the elements closed right after they start,
+// in lenient mode.
+func (dec *Decoder) SetAutoClose(names []string) {
+	dec.autoClose = names
+}
+
+// SetMaxAttributes limits the number of attributes of each element to n, 0
+// meaning no limit, the policy deciding what happens beyond it. This bounds the
+// size of the decoded tree for untrusted input; the XML parser itself still
+// reads all the attributes of a start tag.
+func (dec *Decoder) SetMaxAttributes(n int, policy AttributeLimitPolicy) {
+	dec.maxAttrs = n
+	dec.attrPolicy = policy
+}
+
+// SetAttributeCollisionPolicy sets what happens when attributes of an element
+// have the same name once their namespaces are stripped, see
+// AttributeCollisionPolicy. AttributeCollisionArray is the default.
+func (dec *Decoder) SetAttributeCollisionPolicy(policy AttributeCollisionPolicy) {
+	dec.attrCollision = policy
+}
+
+// SetNormalizeTextNewlines turns the CRLF and CR line endings of the text of
+// elements into LF. The XML parser already does it for the line endings written
+// as is, in text and CDATA sections alike, so this is about those written as
+// character references, such as &#13;&#10;. Attribute values and raw elements
+// are left alone.
+func (dec *Decoder) SetNormalizeTextNewlines(b bool) {
+	dec.normalizeNewlines = b
+}
+
+// SetCommentStyle sets how comments are kept, see CommentStyle. Comments around
+// the XML root element are children of the root node.
+func (dec *Decoder) SetCommentStyle(style CommentStyle) {
+	dec.commentStyle = style
+}
+
+// SetNamespaceAsField makes each element with a namespace carry the namespace
+// and its local name as two children, labeled "#ns" and "#local" by default
+// (the content prefix followed by "ns" and "local"), see SetNamespaceFields:
+// <s:Body xmlns:s="urn:soap"/> gives {"Body": {"#local": "Body", "#ns":
+// "urn:soap", "-s": "urn:soap"}}. The namespace is the URI the prefix is bound
+// to, or the prefix itself when it is not declared. Elements without a
+// namespace are left alone, as are the namespaces of attributes.
+func (dec *Decoder) SetNamespaceAsField(b bool) {
+	dec.namespaceAsField = b
+}
+
+// SetNamespaceFields sets the labels of the children added by
+// SetNamespaceAsField, an empty label keeping the default one
+func (dec *Decoder) SetNamespaceFields(nsLabel, localLabel string) {
+	dec.nsField = nsLabel
+	dec.localField = localLabel
+}
+
+// namespaceField returns label, or the content prefix followed by name when
+// label is empty
+func (dec *Decoder) namespaceField(label, name string) string {
+	if label == "" {
+		return dec.contentPrefix + name
+	}
+	return label
+}
+
+// SetRawElements makes the decoder keep the inner XML of the elements with the
+// given names as is, markup included, in the Data of their node, with Raw set;
+// the Encoder then writes it as a JSON string, escaped as any other string.
+// Their attributes are decoded as usual. This is meant for embedded documents,
+// such as SVG images or signatures, which must not be converted. The input must
+// be UTF-8, or UTF-16 with a byte order mark: other encodings give an error.
+func (dec *Decoder) SetRawElements(names ...string) {
+	if dec.rawElements == nil {
+		dec.rawElements = map[string]bool{}
+	}
+	for _, name := range names {
+		dec.rawElements[name] = true
+	}
+}
+
+// DecodeWithCustomPrefixes is like Decode with the given content and attribute
+// prefixes. An empty one stands for the default, "#" or "-": use
+// SetAttributePrefix for attribute labels without a prefix.
+func (dec *Decoder) DecodeWithCustomPrefixes(root *Node, content string, attribute string) error {
+	if content == "" {
+		content = contentPrefix
+	}
+	if attribute == "" {
+		attribute = attrPrefix
+	}
+	dec.contentPrefix = content
+	dec.attributePrefix = attribute
 	return dec.Decode(root)
 }
 
 // NewDecoder returns a new decoder that reads from r.
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{r: r}
+	return &Decoder{
+		r:               r,
+		attributePrefix: attrPrefix,
+		contentPrefix:   contentPrefix,
+		stripBOM:        true,
+		autoClose:       xml.HTMLAutoClose,
+		internNames:     true,
+	}
+}
+
+// DecodeInto is like Decode, but first clears root so that nothing from a
+// previous document is kept. The nodes of the previous tree under root, their
+// children maps included, are reused for the new one, which saves allocations
+// when decoding many documents in a loop: none of them must be kept, nor be
+// shared between two places of the tree.
+func (dec *Decoder) DecodeInto(root *Node) error {
+	dec.free = root.recycle(dec.free[:0])
+	err := dec.Decode(root)
+	dec.free = nil
+	return err
+}
+
+// newNode returns an empty element node, one of the free ones if any
+func (dec *Decoder) newNode() *Node {
+	if n := dec.reuse(); n != nil {
+		return n
+	}
+	return NewNode("")
+}
+
+// newAttribute returns the node of an attribute holding data, one of the free
+// ones if any. Otherwise, it is built without children map, as it never has
+// children.
+func (dec *Decoder) newAttribute(data string) *Node {
+	n := dec.reuse()
+	if n == nil {
+		n = &Node{}
+	}
+	n.Data, n.IsAttribute = data, true
+	return n
+}
+
+// reuse returns one of the free nodes, or nil if there are none
+func (dec *Decoder) reuse() *Node {
+	n := len(dec.free)
+	if n == 0 {
+		return nil
+	}
+	node := dec.free[n-1]
+	dec.free = dec.free[:n-1]
+	return node
+}
+
+// Losses returns the information lost by the last call to Decode
+func (dec *Decoder) Losses() Loss {
+	return dec.loss
+}
+
+// Lossless returns whether the last call to Decode kept all the information of
+// the XML document, in which case encoding the tree loses nothing either as
+// long as the encoder keeps the insertion order.
+func (dec *Decoder) Lossless() bool {
+	return dec.loss == 0
 }
 
 // Decode reads the next JSON-encoded value from its
 // input and stores it in the value pointed to by v.
+// A malformed or truncated document gives the parse error.
 func (dec *Decoder) Decode(root *Node) error {
+	return dec.decode(root, nil)
+}
+
+// Stream decodes the document and sends each child element of the XML root
+// element on the node channel as soon as it is complete, instead of building
+// the whole tree. The root element itself is not sent, nor are its attributes
+// and text. The channel is unbuffered, so decoding waits for each node to be
+// received: a slow consumer slows the decoder down rather than making memory
+// grow. Both channels are closed at the end of the document; the error
+// channel first receives the parse error, or ctx.Err() if ctx is done before.
+func (dec *Decoder) Stream(ctx context.Context) (<-chan *Node, <-chan error) {
+	nodes := make(chan *Node)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(nodes)
 
-	if dec.contentPrefix == "" {
-		dec.contentPrefix = contentPrefix
+		err := dec.decode(NewNode(""), func(n *Node) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case nodes <- n:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			errc <- err
+		}
+	}()
+
+	return nodes, errc
+}
+
+// PeekRoot returns the name of the XML root element and its attributes, read
+// from r without parsing the rest of the document, e.g. to route a message by
+// its root. It reads r one byte at a time up to the end of the start tag of
+// the root element, the XML declaration, comments and such before it
+// included: the rest of r is left unread. Names are local names, without
+// namespace prefix; an attribute repeated in different namespaces keeps its
+// last value. The input must be UTF-8.
+func PeekRoot(r io.Reader) (name string, attrs map[string]string, err error) {
+	xmlDec := xml.NewDecoder(&byteReader{r: r})
+	xmlDec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		if !strings.EqualFold(label, "utf-8") {
+			return nil, fmt.Errorf("xml2json: PeekRoot needs UTF-8 input, not %s", label)
+		}
+		return input, nil
 	}
-	if dec.attributePrefix == "" {
-		dec.attributePrefix = attrPrefix
+	for {
+		t, err := xmlDec.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", nil, err
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			attrs := make(map[string]string, len(se.Attr))
+			for _, a := range se.Attr {
+				attrs[a.Name.Local] = a.Value
+			}
+			return se.Name.Local, attrs, nil
+		}
 	}
+}
+
+// byteReader reads r one byte at a time, so that the XML parser, which
+// buffers other readers, reads no further than the tokens it returns
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(br.r, br.buf[:]); err != nil {
+		return 0, err
+	}
+	return br.buf[0], nil
+}
 
-	xmlDec := xml.NewDecoder(dec.r)
+func (br *byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = b
+	return 1, nil
+}
+
+// decode decodes the document into root. When record is not nil, it is called
+// with each child element of the XML root element instead of adding them to
+// the tree.
+func (dec *Decoder) decode(root *Node, record func(n *Node) error) error {
+	dec.loss = 0
+
+	r, transcoded := dec.r, false
+	if dec.stripBOM {
+		r, transcoded = stripBOM(dec.r)
+	}
+	var rec *recorder
+	if dec.rawElements != nil {
+		rec = &recorder{r: bufio.NewReader(r)}
+		r = rec
+	}
+	xmlDec := xml.NewDecoder(r)
 
 	// That will convert the charset if the provided XML is non-UTF-8
 	xmlDec.CharsetReader = charset.NewReaderLabel
+	if rec != nil {
+		// Offsets in the converted input would not match the recorded bytes
+		xmlDec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+			if !strings.EqualFold(label, "utf-8") && !(transcoded && strings.HasPrefix(strings.ToLower(label), "utf-16")) {
+				return nil, fmt.Errorf("xml2json: raw elements need UTF-8 input, not %s", label)
+			}
+			return input, nil
+		}
+	}
+	if dec.lenient {
+		xmlDec.Strict = false
+		xmlDec.AutoClose = dec.autoClose
+		xmlDec.Entity = xml.HTMLEntity
+	}
+	if transcoded && rec == nil {
+		// The UTF-16 input is already converted, whatever its declaration says
+		xmlDec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+			if strings.HasPrefix(strings.ToLower(label), "utf-16") {
+				return input, nil
+			}
+			return charset.NewReaderLabel(label, input)
+		}
+	}
+
+	// The XML parser allocates the names of each token: documents repeating
+	// the same names keep a single copy of each in the tree
+	names := internedNames{}
+	attrLabels := internedNames{}
+	if !dec.internNames {
+		names, attrLabels = nil, nil
+	}
 
 	// Create first element from the root node
 	elem := &element{
@@ -68,42 +549,391 @@ func (dec *Decoder) Decode(root *Node) error {
 		n:      root,
 	}
 
+	// end closes the current element, adding it to its parent
+	end := func() error {
+		dec.endText(elem)
+		if record != nil && elem.depth == 2 {
+			if err := record(elem.n); err != nil {
+				return err
+			}
+		} else if elem.parent != nil {
+			dec.addChild(elem.parent, elem)
+		}
+
+		// Then change the current element to its parent
+		elem = elem.parent
+		return nil
+	}
+
 	for {
-		t, _ := xmlDec.Token()
-		if t == nil {
+		t, err := xmlDec.Token()
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return err
+		}
 
 		switch se := t.(type) {
 		case xml.StartElement:
+			dec.endText(elem)
+			label := names.intern(se.Name.Local, "")
+			for _, c := range elem.comments {
+				c.AddChild("next", &Node{Data: label})
+			}
+			elem.comments = elem.comments[:0]
+			elem.lastLabel = label
+
 			// Build new a new current element and link it to its parent
 			elem = &element{
-				parent: elem,
-				n:      &Node{},
-				label:  se.Name.Local,
+				parent:   elem,
+				n:        dec.newNode(),
+				label:    label,
+				depth:    elem.depth + 1,
+				preserve: elem.preserve,
+			}
+			if se.Name.Space != "" {
+				if dec.namespaceAsField {
+					elem.n.AddChild(dec.namespaceField(dec.nsField, "ns"), &Node{Data: se.Name.Space})
+					elem.n.AddChild(dec.namespaceField(dec.localField, "local"), &Node{Data: label})
+				} else {
+					dec.loss |= LossNamespaces
+				}
+			}
+
+			if defaults, ok := dec.attrDefaults[se.Name.Local]; ok {
+				se.Attr = withDefaults(se.Attr, defaults)
+			}
+			if dec.maxAttrs > 0 && len(se.Attr) > dec.maxAttrs {
+				if dec.attrPolicy == AttributesError {
+					return fmt.Errorf("element %q has %d attributes: %w", elem.path(), len(se.Attr), ErrTooManyAttributes)
+				}
+				se.Attr = se.Attr[:dec.maxAttrs]
+				dec.loss |= LossAttributes
 			}
 
 			// Extract attributes as children
+			contentAttr, hasContentAttr := dec.attrAsContent[se.Name.Local]
 			for _, a := range se.Attr {
-				elem.n.AddChild(dec.attributePrefix+a.Name.Local, &Node{Data: a.Value})
+				if dec.dropXmlns && isNamespaceDeclaration(a) {
+					continue
+				}
+				if a.Name.Space != "" && a.Name.Space != "xmlns" && !isXMLSpace(a) {
+					dec.loss |= LossNamespaces
+				}
+				if isXMLSpace(a) {
+					// Whitespace is kept as is in preserved elements
+					elem.preserve = a.Value == "preserve"
+				}
+				if dec.xsiNil && isXsiNil(a) {
+					elem.n.Null = a.Value == "true" || a.Value == "1"
+					continue
+				}
+				if hasContentAttr && a.Name.Local == contentAttr {
+					elem.n.Data = a.Value
+					elem.promoted = true
+					continue
+				}
+				attrLabel := attrLabels.intern(a.Name.Local, dec.attributePrefix)
+				if same := elem.n.Children[attrLabel]; len(same) > 0 && dec.attrCollision != AttributeCollisionArray {
+					if dec.attrCollision == AttributeCollisionError {
+						return fmt.Errorf("element %q has several %q attributes: %w", elem.path(), a.Name.Local, ErrAttributeCollision)
+					}
+					if dec.attrCollision == AttributeCollisionKeepLast {
+						same[0].Data = a.Value
+					}
+					dec.loss |= LossAttributes
+					continue
+				}
+				elem.n.AddChild(attrLabel, dec.newAttribute(a.Value))
+			}
+			elem.n.Preserved = elem.preserve
+
+			if dec.rawElements[se.Name.Local] {
+				if elem.n.Data, err = rawContent(xmlDec, rec); err != nil {
+					return err
+				}
+				elem.n.Raw = true
+				if err := end(); err != nil {
+					return err
+				}
 			}
 		case xml.CharData:
-			// Extract XML data (if any)
-			elem.n.Data = trimNonGraphic(string(xml.CharData(se)))
+			// Extract XML data (if any), unless an attribute already took its place
+			if elem.promoted {
+				break
+			}
+			if !elem.inText {
+				// A new run of text, after a child element
+				elem.text = elem.text[:0]
+				elem.inText = true
+			}
+			// Text and CDATA sections up to the next child element make up a
+			// single value, set by endText once complete
+			elem.text = append(elem.text, se...)
+		case xml.Comment:
+			dec.comment(elem, se, xmlDec.InputOffset())
+		case xml.ProcInst:
+			if se.Target != "xml" {
+				dec.loss |= LossProcInsts
+			}
+		case xml.Directive:
+			dec.loss |= LossDirectives
 		case xml.EndElement:
-			// And add it to its parent list
-			if elem.parent != nil {
-				elem.parent.n.AddChild(elem.label, elem.n)
+			if err := end(); err != nil {
+				return err
 			}
-
-			// Then change the current element to its parent
-			elem = elem.parent
 		}
 	}
+	dec.endText(elem)
 
 	return nil
 }
 
+// endText ends the run of text of e, if any, making it the text of e unless
+// it is empty
+func (dec *Decoder) endText(e *element) {
+	if !e.inText {
+		return
+	}
+	e.inText = false
+
+	data := string(e.text)
+	if !e.preserve {
+		data = trimNonGraphic(data)
+		if data != "" && len(data) != len(e.text) {
+			dec.loss |= LossWhitespace
+		}
+	}
+	if dec.normalizeNewlines {
+		data = strings.ReplaceAll(strings.ReplaceAll(data, "\r\n", "\n"), "\r", "\n")
+	}
+	if data != "" {
+		if e.hasChild {
+			dec.loss |= LossMixedContent
+		}
+		e.n.Data = data
+		e.hasText = true
+	}
+}
+
+// internedNames maps names to the single copy of their label kept in a tree
+type internedNames map[string]string
+
+// intern returns prefix+name, reusing the string returned for name before. A
+// nil map never reuses anything.
+func (in internedNames) intern(name, prefix string) string {
+	if label, ok := in[name]; ok {
+		return label
+	}
+	label := prefix + name
+	if in != nil {
+		in[name] = label
+	}
+	return label
+}
+
+// recorder keeps the bytes read from r while recording, from offset base, so
+// that raw elements can be sliced out of the input. Being an io.ByteReader, the
+// XML parser reads from it without buffering ahead: outside of raw elements,
+// only the last byte read is kept, the one the parser may put back.
+type recorder struct {
+	r         *bufio.Reader
+	buf       []byte
+	base      int64
+	recording bool
+}
+
+func (rec *recorder) ReadByte() (byte, error) {
+	b, err := rec.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if !rec.recording {
+		rec.base += int64(len(rec.buf))
+		rec.buf = rec.buf[:0]
+	}
+	rec.buf = append(rec.buf, b)
+	return b, nil
+}
+
+func (rec *recorder) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b, err := rec.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = b
+	return 1, nil
+}
+
+// stop stops recording, dropping the bytes recorded but the last one
+func (rec *recorder) stop() {
+	rec.recording = false
+	if n := len(rec.buf); n > 1 {
+		rec.base += int64(n - 1)
+		rec.buf = append([]byte(nil), rec.buf[n-1])
+	}
+}
+
+// rawContent returns the input up to the end of the current element, whose
+// start tag was just read, and consumes its tokens
+func rawContent(xmlDec *xml.Decoder, rec *recorder) (string, error) {
+	start := xmlDec.InputOffset()
+	// Nothing before is needed
+	rec.buf = rec.buf[start-rec.base:]
+	rec.base = start
+	rec.recording = true
+	defer rec.stop()
+
+	for depth := 0; ; {
+		off := xmlDec.InputOffset()
+		t, err := xmlDec.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			if depth == 0 {
+				return string(rec.buf[:off-start]), nil
+			}
+			depth--
+		}
+	}
+}
+
+// isXsiNil returns whether a is an xsi:nil attribute. An undeclared xsi prefix
+// is accepted as well, since it is common in hand written SOAP messages.
+func isXsiNil(a xml.Attr) bool {
+	return a.Name.Local == "nil" && (a.Name.Space == xsiNamespace || a.Name.Space == "xsi")
+}
+
+// path returns the labels from the XML root element to e, separated by dots
+func (e *element) path() string {
+	var labels []string
+	for ; e != nil && e.depth > 0; e = e.parent {
+		labels = append(labels, e.label)
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// addChild adds the node of the element c to the node of its parent e, and
+// keeps track of what this loses
+func (dec *Decoder) addChild(e, c *element) {
+	e.n.AddChild(c.label, c.n)
+
+	if e.hasText {
+		dec.loss |= LossMixedContent
+	}
+	e.hasChild = true
+
+	if c.label != e.lastChild {
+		if e.seen == nil {
+			e.seen = map[string]bool{}
+		}
+		if e.seen[c.label] {
+			dec.loss |= LossOrder
+		}
+		e.seen[c.label] = true
+		e.lastChild = c.label
+	}
+}
+
+// comment keeps the comment c, ending at offset end, in e as per the comment
+// style
+func (dec *Decoder) comment(e *element, c xml.Comment, end int64) {
+	label := dec.contentPrefix + "comment"
+	switch dec.commentStyle {
+	case CommentsText:
+		e.n.AddChild(label, &Node{Data: string(c)})
+	case CommentsStructured:
+		n := NewNode("")
+		n.AddChild("text", &Node{Data: string(c)})
+		n.AddChild("offset", &Node{Data: strconv.FormatInt(end-int64(len(c))-int64(len("<!---->")), 10)})
+		if e.lastLabel != "" {
+			n.AddChild("previous", &Node{Data: e.lastLabel})
+		}
+		e.n.AddChild(label, n)
+		e.comments = append(e.comments, n)
+	default:
+		dec.loss |= LossComments
+	}
+}
+
+// withDefaults returns attrs with the defaults they lack appended, in sorted
+// order of names
+func withDefaults(attrs []xml.Attr, defaults map[string]string) []xml.Attr {
+	names := make([]string, 0, len(defaults))
+	for name := range defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := attrs
+	for _, name := range names {
+		found := false
+		for _, a := range attrs {
+			if a.Name.Local == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, xml.Attr{Name: xml.Name{Local: name}, Value: defaults[name]})
+		}
+	}
+	return res
+}
+
+// stripBOM returns r without its leading byte order mark, if any. Input with a
+// UTF-16 byte order mark is converted to UTF-8, in which case transcoded is
+// true.
+func stripBOM(r io.Reader) (res io.Reader, transcoded bool) {
+	br := bufio.NewReader(r)
+	b, _ := br.Peek(3)
+
+	switch {
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		br.Discard(3)
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		br.Discard(2)
+		return mustReaderLabel("utf-16be", br), true
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+		br.Discard(2)
+		return mustReaderLabel("utf-16le", br), true
+	}
+	return br, false
+}
+
+// mustReaderLabel is charset.NewReaderLabel, for labels known to be supported
+func mustReaderLabel(label string, r io.Reader) io.Reader {
+	res, err := charset.NewReaderLabel(label, r)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// isNamespaceDeclaration returns whether a is an xmlns or xmlns:* attribute
+func isNamespaceDeclaration(a xml.Attr) bool {
+	return a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns")
+}
+
+// isXMLSpace returns whether a is an xml:space attribute
+func isXMLSpace(a xml.Attr) bool {
+	return a.Name.Local == "space" && (a.Name.Space == xmlNamespace || a.Name.Space == "xml")
+}
+
 // trimNonGraphic returns a slice of the string s, with all leading and trailing
 // non graphic characters and spaces removed.
 //
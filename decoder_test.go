@@ -1,8 +1,18 @@
 package xml2json
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"runtime"
 	"strings"
 	"testing"
+	"unicode/utf16"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,6 +46,15 @@ func TestDecode(t *testing.T) {
 	err = dec.DecodeWithCustomPrefixes(root, "test3", "test4")
 	assert.NoError(err)
 
+	// Empty prefixes stand for the default ones
+	root = &Node{}
+	dec = NewDecoder(strings.NewReader(`<a b="1"><!--c--></a>`))
+	dec.SetAttributePrefix("test")
+	dec.SetCommentStyle(CommentsText)
+	assert.NoError(dec.DecodeWithCustomPrefixes(root, "", ""))
+	a := root.Children["a"][0]
+	assert.Contains(a.Children, "-b")
+	assert.Contains(a.Children, "#comment")
 }
 
 func TestTrim(t *testing.T) {
@@ -63,3 +82,716 @@ func TestTrim(t *testing.T) {
 		assert.Equal(t, scenario.expected, got)
 	}
 }
+
+// TestDecodeAttributeAsContent ensures that an attribute can be promoted to content
+func TestDecodeAttributeAsContent(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<?xml version="1.0" encoding="UTF-8"?>
+  <values>
+   <value v="42"/>
+   <weight v="12" unit="kg"> </weight>
+   <other v="1"/>
+  </values>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetAttributeAsContent("value", "v")
+	dec.SetAttributeAsContent("weight", "v")
+	assert.NoError(dec.Decode(root))
+
+	values := root.Children["values"][0]
+	assert.Equal("42", values.Children["value"][0].Data)
+	assert.False(values.Children["value"][0].HasChildren())
+
+	weight := values.Children["weight"][0]
+	assert.Equal("12", weight.Data)
+	assert.Equal("kg", weight.Children["-unit"][0].Data)
+	assert.Len(weight.Children["-v"], 0)
+
+	assert.Equal("1", values.Children["other"][0].Children["-v"][0].Data)
+}
+
+// benchmarkDocument returns an XML document with n node elements
+func benchmarkDocument(n int) string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?><osm version="0.6">`)
+	for ii := 0; ii < n; ii++ {
+		fmt.Fprintf(&sb, `<node id="%d" lat="54.09" lon="12.24"><tag k="name" v="n%d"/><tag k="ref" v="%d"/></node>`, ii, ii, ii)
+	}
+	sb.WriteString(`</osm>`)
+	return sb.String()
+}
+
+func BenchmarkDecode(b *testing.B) {
+	s := benchmarkDocument(1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		root := &Node{}
+		if err := NewDecoder(strings.NewReader(s)).Decode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkDecodeHeap decodes a document repeating the same names, reporting
+// the heap size of the tree
+func benchmarkDecodeHeap(b *testing.B, intern bool) {
+	s := benchmarkDocument(1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var heap uint64
+	for ii := 0; ii < b.N; ii++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		root := &Node{}
+		dec := NewDecoder(strings.NewReader(s))
+		dec.internNames = intern
+		if err := dec.Decode(root); err != nil {
+			b.Fatal(err)
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		heap += after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(root)
+	}
+	b.ReportMetric(float64(heap)/float64(b.N), "heap-B/op")
+}
+
+func BenchmarkDecodeInternedNames(b *testing.B) {
+	benchmarkDecodeHeap(b, true)
+}
+
+func BenchmarkDecodeNamesNotInterned(b *testing.B) {
+	benchmarkDecodeHeap(b, false)
+}
+
+// wideDocument returns an XML document whose root element has n children, with
+// a few distinct names interleaved
+func wideDocument(n int) string {
+	var sb strings.Builder
+	sb.WriteString(`<rows>`)
+	for ii := 0; ii < n; ii++ {
+		fmt.Fprintf(&sb, `<row%d id="%d">%d</row%d>`, ii%3, ii, ii, ii%3)
+	}
+	sb.WriteString(`</rows>`)
+	return sb.String()
+}
+
+// BenchmarkDecodeWide decodes an element with 100k children, whose cost must
+// stay linear in their number
+func BenchmarkDecodeWide(b *testing.B) {
+	s := wideDocument(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		root := &Node{}
+		if err := NewDecoder(strings.NewReader(s)).Decode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestDecodeInternedNames ensures that repeated names share a single string
+func TestDecodeInternedNames(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(benchmarkDocument(2))).Decode(root))
+
+	nodes := root.Get("osm.node")
+	assert.Len(nodes, 2)
+	first, second := nodes[0].childOrder, nodes[1].childOrder
+	assert.Equal([]string{"-id", "-lat", "-lon", "tag", "tag"}, first)
+	for ii := range first {
+		assert.Same(unsafe.StringData(first[ii]), unsafe.StringData(second[ii]))
+	}
+	assert.Same(unsafe.StringData(first[3]), unsafe.StringData(first[4]))
+}
+
+// TestDecodeXMLSpace ensures that whitespace is kept in xml:space="preserve" elements
+func TestDecodeXMLSpace(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<doc>
+	<trimmed>  a  </trimmed>
+	<poem xml:space="preserve">  roses  <line>  red  </line><reset xml:space="default">  violets  <code xml:space="preserve">  blue  </code></reset></poem>
+</doc>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	doc := root.Children["doc"][0]
+	assert.Equal("a", doc.Children["trimmed"][0].Data)
+
+	poem := doc.Children["poem"][0]
+	assert.Equal("preserve", poem.Children["-space"][0].Data)
+	assert.Equal("  red  ", poem.Children["line"][0].Data)
+
+	reset := poem.Children["reset"][0]
+	assert.Equal("violets", reset.Data)
+	assert.Equal("  blue  ", reset.Children["code"][0].Data)
+}
+
+// TestDecodeInto ensures that nothing is kept from the previous document
+func TestDecodeInto(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a x="1"><b>foo</b></a>`)).DecodeInto(root))
+	assert.Equal("foo", root.Children["a"][0].Children["b"][0].Data)
+
+	root.Data = "stale"
+	root.Null = true
+	assert.NoError(NewDecoder(strings.NewReader(`<c>bar</c>`)).DecodeInto(root))
+	assert.Len(root.Children, 1)
+	assert.Equal("bar", root.Children["c"][0].Data)
+	assert.Equal([]string{"c"}, root.orderedLabels())
+	assert.Empty(root.Data)
+	assert.False(root.Null)
+
+	// Without nodes to reuse, attributes get no children map
+	fresh := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a x="1"/>`)).Decode(fresh))
+	assert.Nil(fresh.Get("a.-x")[0].Children)
+
+	// Recycled nodes keep nothing of their previous use
+	for _, doc := range []string{`<a x="1" y="2"><b raw="r">foo</b><b/></a>`, `<p><q><r>1</r><s>2</s></q><t/></p>`, `<a><b>only</b></a>`} {
+		root.IsAttribute = true
+		assert.NoError(NewDecoder(strings.NewReader(doc)).DecodeInto(root))
+		fresh := &Node{}
+		assert.NoError(NewDecoder(strings.NewReader(doc)).Decode(fresh))
+		assert.Empty(Diff(fresh, root), doc)
+		assert.False(root.IsAttribute)
+		assert.NoError(root.Walk(func(path []string, n *Node) error {
+			assert.Equal(len(path) > 0 && strings.HasPrefix(path[len(path)-1], "-"), n.IsAttribute, strings.Join(path, "."))
+			return nil
+		}))
+	}
+}
+
+func BenchmarkDecodeInto(b *testing.B) {
+	s := benchmarkDocument(10)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	root := &Node{}
+	for ii := 0; ii < b.N; ii++ {
+		if err := NewDecoder(strings.NewReader(s)).DecodeInto(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeNew(b *testing.B) {
+	s := benchmarkDocument(10)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		root := &Node{}
+		if err := NewDecoder(strings.NewReader(s)).Decode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestDecodeAttributeDefaults ensures that defaults are only added where missing
+func TestDecodeAttributeDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<list><item type="a"/><item/><other/></list>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetAttributeDefaults("item", map[string]string{"type": "default", "lang": "en"})
+	assert.NoError(dec.Decode(root))
+
+	items := root.Children["list"][0].Children["item"]
+	assert.Equal("a", items[0].Children["-type"][0].Data)
+	assert.Equal("en", items[0].Children["-lang"][0].Data)
+	assert.Equal("default", items[1].Children["-type"][0].Data)
+	assert.True(items[1].Children["-type"][0].IsAttribute)
+	assert.Equal("en", items[1].Children["-lang"][0].Data)
+	assert.False(root.Children["list"][0].Children["other"][0].HasChildren())
+}
+
+// TestDecodeLosses ensures that the information lost while decoding is reported
+func TestDecodeLosses(t *testing.T) {
+	assert := assert.New(t)
+
+	table := []struct {
+		in       string
+		expected Loss
+	}{
+		{in: `<?xml version="1.0"?><a x="1"><b>foo</b><b>bar</b><c/></a>`, expected: 0},
+		{in: `<a>foo<!-- comment --></a>`, expected: LossComments},
+		{in: `<a><?php echo 1; ?></a>`, expected: LossProcInsts},
+		{in: `<!DOCTYPE a><a/>`, expected: LossDirectives},
+		{in: `<a> foo </a>`, expected: LossWhitespace},
+		{in: `<a>
+  <b>foo</b>
+</a>`, expected: 0},
+		{in: `<a>foo<b/></a>`, expected: LossMixedContent},
+		{in: `<a><b/>foo</a>`, expected: LossMixedContent},
+		{in: `<a><b/><c/><b/></a>`, expected: LossOrder},
+		{in: `<x:a xmlns:x="urn:x"/>`, expected: LossNamespaces},
+		{in: `<a x:b="1" xmlns:x="urn:x"/>`, expected: LossNamespaces},
+	}
+
+	for _, scenario := range table {
+		dec := NewDecoder(strings.NewReader(scenario.in))
+		assert.NoError(dec.Decode(&Node{}))
+		assert.Equal(scenario.expected, dec.Losses(), scenario.in)
+		assert.Equal(scenario.expected == 0, dec.Lossless(), scenario.in)
+	}
+}
+
+// TestDecodeStream ensures that the records are sent one by one
+func TestDecodeStream(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<rows total="3"><row id="1"/><row id="2"/><other>x</other></rows>`
+
+	nodes, errc := NewDecoder(strings.NewReader(s)).Stream(context.Background())
+	var records []*Node
+	for n := range nodes {
+		records = append(records, n)
+	}
+	assert.NoError(<-errc)
+	assert.Len(records, 3)
+	assert.Equal("1", records[0].Children["-id"][0].Data)
+	assert.Equal("2", records[1].Children["-id"][0].Data)
+	assert.Equal("x", records[2].Data)
+
+	// Parse errors are reported
+	nodes, errc = NewDecoder(strings.NewReader(`<rows><row></rows>`)).Stream(context.Background())
+	for range nodes {
+	}
+	assert.Error(<-errc)
+
+	// A canceled context stops the decoder
+	ctx, cancel := context.WithCancel(context.Background())
+	nodes, errc = NewDecoder(strings.NewReader(s)).Stream(ctx)
+	<-nodes
+	cancel()
+	for range nodes {
+	}
+	assert.Equal(context.Canceled, <-errc)
+}
+
+// TestDecodeError ensures that malformed documents are reported
+func TestDecodeError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(NewDecoder(strings.NewReader(`<a><b></a>`)).Decode(&Node{}))
+	assert.NoError(NewDecoder(strings.NewReader(``)).Decode(&Node{}))
+}
+
+// TestDecodeBOM ensures that documents starting with a byte order mark are decoded
+func TestDecodeBOM(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `<?xml version="1.0" encoding="%s"?><a>über</a>`
+	utf16be := func(s string) []byte {
+		var b []byte
+		for _, r := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(r>>8), byte(r))
+		}
+		return b
+	}
+	utf16le := func(s string) []byte {
+		b := utf16be(s)
+		for ii := 0; ii < len(b); ii += 2 {
+			b[ii], b[ii+1] = b[ii+1], b[ii]
+		}
+		return b
+	}
+
+	table := [][]byte{
+		append([]byte{0xEF, 0xBB, 0xBF}, fmt.Sprintf(doc, "UTF-8")...),
+		append([]byte{0xFE, 0xFF}, utf16be(fmt.Sprintf(doc, "UTF-16"))...),
+		append([]byte{0xFF, 0xFE}, utf16le(fmt.Sprintf(doc, "UTF-16"))...),
+		append([]byte{0xFF, 0xFE}, utf16le(`<a>über</a>`)...),
+	}
+
+	for _, in := range table {
+		root := &Node{}
+		assert.NoError(NewDecoder(bytes.NewReader(in)).Decode(root))
+		assert.Empty(root.Data)
+		assert.Equal("über", root.Children["a"][0].Data)
+	}
+
+	// Without stripping, UTF-16 cannot be decoded
+	dec := NewDecoder(bytes.NewReader(table[1]))
+	dec.SetStripInputBOM(false)
+	root := &Node{}
+	dec.Decode(root)
+	assert.Len(root.Children["a"], 0)
+}
+
+// TestDecodeLenient ensures that HTML-ish documents can be decoded
+func TestDecodeLenient(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<p>Hello&nbsp;world<br><img src=logo alt="Logo"><input disabled></p>`
+
+	assert.Error(NewDecoder(strings.NewReader(s)).Decode(&Node{}))
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetLenient(true)
+	assert.NoError(dec.Decode(root))
+
+	p := root.Children["p"][0]
+	assert.Equal("Hello world", p.Data)
+	assert.Len(p.Children["br"], 1)
+	assert.Equal("logo", p.Children["img"][0].Children["-src"][0].Data)
+	assert.Equal("Logo", p.Children["img"][0].Children["-alt"][0].Data)
+	assert.Len(p.Children["input"][0].Children["-disabled"], 1)
+
+	// Elements which are not auto-closed nest
+	root = &Node{}
+	dec = NewDecoder(strings.NewReader(`<p>a<br>b</p>`))
+	dec.SetLenient(true)
+	dec.SetAutoClose([]string{"img"})
+	assert.NoError(dec.Decode(root))
+	assert.Equal("b", root.Children["p"][0].Children["br"][0].Data)
+}
+
+// TestDecodeRawElements ensures that raw elements keep their inner XML verbatim
+func TestDecodeRawElements(t *testing.T) {
+	assert := assert.New(t)
+
+	svg := `<circle cx="5" r="4"/><g id="a"><!-- c --><text>1 &lt; 2</text></g>`
+	s := `<page><title>Logo</title><svg width="10">` + svg + `</svg><sig/><after>x</after></page>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetRawElements("svg", "sig")
+	assert.NoError(dec.Decode(root))
+
+	n := root.Get("page.svg")[0]
+	assert.True(n.Raw)
+	assert.Equal(svg, n.Data)
+	assert.Equal("10", n.Children["-width"][0].Data)
+	assert.Empty(n.Children["circle"])
+	assert.Equal("", root.Get("page.sig")[0].Data)
+	assert.Equal("x", root.Get("page.after")[0].Data)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).Encode(root.Get("page.svg")[0]))
+	var v map[string]string
+	assert.NoError(json.Unmarshal(buf.Bytes(), &v))
+	assert.Equal(svg, v["#content"])
+
+	// Other encodings cannot be sliced
+	dec = NewDecoder(strings.NewReader(`<?xml version="1.0" encoding="ISO-8859-1"?><a><svg/></a>`))
+	dec.SetRawElements("svg")
+	assert.Error(dec.Decode(&Node{}))
+
+	dec = NewDecoder(strings.NewReader(`<a><svg><b></a>`))
+	dec.SetRawElements("svg")
+	assert.Error(dec.Decode(&Node{}))
+}
+
+// TestRecorder ensures that only raw elements are kept in memory
+func TestRecorder(t *testing.T) {
+	assert := assert.New(t)
+
+	filler := strings.Repeat("<p>filler text</p>", 500)
+	s := `<doc>` + filler + `<svg><g/></svg>` + filler + `<svg><h/></svg>` + filler + `</doc>`
+	rec := &recorder{r: bufio.NewReader(strings.NewReader(s))}
+	xmlDec := xml.NewDecoder(rec)
+
+	var raws []string
+	for {
+		t, err := xmlDec.Token()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+		if se, ok := t.(xml.StartElement); ok && se.Name.Local == "svg" {
+			raw, err := rawContent(xmlDec, rec)
+			assert.NoError(err)
+			raws = append(raws, raw)
+		}
+		assert.LessOrEqual(len(rec.buf), 1)
+	}
+	assert.Equal([]string{"<g/>", "<h/>"}, raws)
+}
+
+// TestDecodeMaxAttributes ensures that elements with too many attributes are rejected or trimmed
+func TestDecodeMaxAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	var sb strings.Builder
+	sb.WriteString(`<doc><list><item a0="x"`)
+	for i := 1; i < 1000; i++ {
+		fmt.Fprintf(&sb, ` a%d="x"`, i)
+	}
+	sb.WriteString(`/></list></doc>`)
+	s := sb.String()
+
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetMaxAttributes(10, AttributesError)
+	err := dec.Decode(&Node{})
+	assert.ErrorIs(err, ErrTooManyAttributes)
+	assert.ErrorContains(err, `"doc.list.item" has 1000 attributes`)
+
+	root := &Node{}
+	dec = NewDecoder(strings.NewReader(s))
+	dec.SetMaxAttributes(10, AttributesDrop)
+	assert.NoError(dec.Decode(root))
+	item := root.Get("doc.list.item")[0]
+	assert.Len(item.Children, 10)
+	assert.Len(item.Children["-a9"], 1)
+	assert.Equal(LossAttributes, dec.Losses())
+
+	dec = NewDecoder(strings.NewReader(s))
+	dec.SetMaxAttributes(1000, AttributesError)
+	assert.NoError(dec.Decode(&Node{}))
+	assert.True(dec.Lossless())
+}
+
+// TestDecodeTextRuns ensures that text and CDATA sections are concatenated
+func TestDecodeTextRuns(t *testing.T) {
+	assert := assert.New(t)
+
+	decode := func(s string) (*Node, Loss) {
+		root := &Node{}
+		dec := NewDecoder(strings.NewReader(s))
+		assert.NoError(dec.Decode(root))
+		return root.Get("a")[0], dec.Losses()
+	}
+
+	a, loss := decode(`<a>text<![CDATA[more]]>text</a>`)
+	assert.Equal("textmoretext", a.Data)
+	assert.Equal(Loss(0), loss)
+
+	a, _ = decode(`<a>  x <![CDATA[<y>]]><!-- c --> &amp; z  </a>`)
+	assert.Equal("x <y> & z", a.Data)
+
+	a, _ = decode(`<a xml:space="preserve"> x <![CDATA[ y ]]> </a>`)
+	assert.Equal(" x  y  ", a.Data)
+
+	// A child element ends the run: the last run with text is kept
+	a, loss = decode(`<a>x<![CDATA[1]]><b/>y<![CDATA[2]]></a>`)
+	assert.Equal("y2", a.Data)
+	assert.Equal(LossMixedContent, loss&LossMixedContent)
+
+	a, _ = decode("<a>x<b/>\n</a>")
+	assert.Equal("x", a.Data)
+
+	// Long runs are only joined once complete
+	a, _ = decode(manySections(20000))
+	assert.Equal(strings.Repeat(sectionText, 20000), a.Data)
+}
+
+// sectionText is the text of each CDATA section of manySections
+const sectionText = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// manySections returns an element holding a run of n CDATA sections
+func manySections(n int) string {
+	return "<a>" + strings.Repeat("<![CDATA["+sectionText+"]]>", n) + "</a>"
+}
+
+// BenchmarkDecodeTextRuns decodes an element with a run of 20k CDATA
+// sections, whose cost must stay linear in their number
+func BenchmarkDecodeTextRuns(b *testing.B) {
+	s := manySections(20000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		root := &Node{}
+		if err := NewDecoder(strings.NewReader(s)).Decode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestDecodeNormalizeTextNewlines ensures that line endings are turned into LF
+func TestDecodeNormalizeTextNewlines(t *testing.T) {
+	assert := assert.New(t)
+
+	s := "<a xml:space=\"preserve\">one\r\ntwo&#13;&#10;three&#13;four<![CDATA[\r\nfive\rsix]]></a>"
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+	assert.Equal("one\ntwo\r\nthree\rfour\nfive\nsix", root.Get("a")[0].Data)
+
+	root = &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetNormalizeTextNewlines(true)
+	assert.NoError(dec.Decode(root))
+	assert.Equal("one\ntwo\nthree\nfour\nfive\nsix", root.Get("a")[0].Data)
+}
+
+// TestDecodeCommentStyle ensures that comments are kept with their position and neighbouring elements
+func TestDecodeCommentStyle(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<!--head--><a><b/><!-- about c --><c>x</c><!--last--></a>`
+
+	decode := func(style CommentStyle) (*Node, *Decoder) {
+		root := &Node{}
+		dec := NewDecoder(strings.NewReader(s))
+		dec.SetCommentStyle(style)
+		assert.NoError(dec.Decode(root))
+		return root, dec
+	}
+
+	root, dec := decode(CommentsDrop)
+	assert.Nil(root.Get("#comment"))
+	assert.Equal(LossComments, dec.Losses())
+
+	root, dec = decode(CommentsText)
+	assert.Equal("head", root.Get("#comment")[0].Data)
+	comments := root.Get("a.#comment")
+	assert.Len(comments, 2)
+	assert.Equal(" about c ", comments[0].Data)
+	assert.Equal("last", comments[1].Data)
+	assert.True(dec.Lossless())
+
+	root, _ = decode(CommentsStructured)
+	data := func(n *Node, path string) string {
+		nodes := n.Get(path)
+		if len(nodes) == 0 {
+			return "<none>"
+		}
+		return nodes[0].Data
+	}
+	head := root.Get("#comment")[0]
+	assert.Equal("head", data(head, "text"))
+	assert.Equal("0", data(head, "offset"))
+	assert.Equal("<none>", data(head, "previous"))
+	assert.Equal("a", data(head, "next"))
+
+	comments = root.Get("a.#comment")
+	assert.Equal(" about c ", data(comments[0], "text"))
+	assert.Equal("<!--", s[18:22])
+	assert.Equal("18", data(comments[0], "offset"))
+	assert.Equal("b", data(comments[0], "previous"))
+	assert.Equal("c", data(comments[0], "next"))
+	assert.Equal("c", data(comments[1], "previous"))
+	assert.Equal("<none>", data(comments[1], "next"))
+
+	// As documented
+	root = &Node{}
+	dec = NewDecoder(strings.NewReader(`<a><b/><!-- x --><c/></a>`))
+	dec.SetCommentStyle(CommentsStructured)
+	assert.NoError(dec.Decode(root))
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"a": {"#comment": {"next": "c", "offset": "7", "previous": "b", "text": " x "}, "b": "", "c": ""}}`+"\n", buf.String())
+}
+
+// TestDecodeNamespaceAsField ensures that namespaced elements carry their namespace and local name
+func TestDecodeNamespaceAsField(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<s:Envelope xmlns:s="urn:soap" xmlns="urn:default"><s:Body><m:Get xmlns:m="urn:api">1</m:Get><plain xmlns="">2</plain><x:y>3</x:y></s:Body></s:Envelope>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetNamespaceAsField(true)
+	dec.SetDropNamespaceDeclarations(true)
+	assert.NoError(dec.Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"Envelope": {"#local": "Envelope", "#ns": "urn:soap", "Body": {"#local": "Body", "#ns": "urn:soap", "Get": {"#content": "1", "#local": "Get", "#ns": "urn:api"}, "plain": "2", "y": {"#content": "3", "#local": "y", "#ns": "x"}}}}`+"\n", buf.String())
+	assert.Zero(dec.Losses() & LossNamespaces)
+
+	root = &Node{}
+	dec = NewDecoder(strings.NewReader(`<s:Body xmlns:s="urn:soap"/>`))
+	dec.SetNamespaceAsField(true)
+	dec.SetNamespaceFields("namespace", "")
+	assert.NoError(dec.Decode(root))
+	assert.Equal("urn:soap", root.Get("Body.namespace")[0].Data)
+	assert.Equal("Body", root.Get("Body.#local")[0].Data)
+
+	root = &Node{}
+	dec = NewDecoder(strings.NewReader(s))
+	assert.NoError(dec.Decode(root))
+	assert.Nil(root.Get("Envelope.#ns"))
+	assert.NotZero(dec.Losses() & LossNamespaces)
+}
+
+// TestDecodeAttributeCollisionPolicy ensures that attributes colliding once stripped of their namespace follow the policy
+func TestDecodeAttributeCollisionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<doc xmlns:a="urn:a" xmlns:b="urn:b"><item a:x="1" b:x="2" y="3"/></doc>`
+
+	decode := func(policy AttributeCollisionPolicy) (*Node, *Decoder, error) {
+		root := &Node{}
+		dec := NewDecoder(strings.NewReader(s))
+		dec.SetAttributeCollisionPolicy(policy)
+		return root, dec, dec.Decode(root)
+	}
+	values := func(root *Node) []string {
+		var sl []string
+		for _, n := range root.Get("doc.item.-x") {
+			sl = append(sl, n.Data)
+		}
+		return sl
+	}
+
+	root, dec, err := decode(AttributeCollisionArray)
+	assert.NoError(err)
+	assert.Equal([]string{"1", "2"}, values(root))
+	assert.Zero(dec.Losses() & LossAttributes)
+
+	root, dec, err = decode(AttributeCollisionKeepFirst)
+	assert.NoError(err)
+	assert.Equal([]string{"1"}, values(root))
+	assert.NotZero(dec.Losses() & LossAttributes)
+
+	root, _, err = decode(AttributeCollisionKeepLast)
+	assert.NoError(err)
+	assert.Equal([]string{"2"}, values(root))
+	assert.Equal([]string{"-x", "-y"}, root.Get("doc.item")[0].orderedLabels())
+
+	_, _, err = decode(AttributeCollisionError)
+	assert.ErrorIs(err, ErrAttributeCollision)
+	assert.ErrorContains(err, `"doc.item" has several "x" attributes`)
+}
+
+// TestPeekRoot ensures that only the start tag of the root element is read
+func TestPeekRoot(t *testing.T) {
+	assert := assert.New(t)
+
+	head := `<?xml version="1.0" encoding="UTF-8"?>
+<!-- routed by action -->
+<soap:Envelope xmlns:soap="urn:soap" soap:action="Get" id="7">`
+	r := strings.NewReader(head + `<soap:Body><Get/></soap:Body></soap:Envelope>`)
+
+	name, attrs, err := PeekRoot(r)
+	assert.NoError(err)
+	assert.Equal("Envelope", name)
+	assert.Equal(map[string]string{"soap": "urn:soap", "action": "Get", "id": "7"}, attrs)
+
+	// The body is left unread
+	rest, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(`<soap:Body><Get/></soap:Body></soap:Envelope>`, string(rest))
+
+	name, attrs, err = PeekRoot(strings.NewReader(`<empty/>`))
+	assert.NoError(err)
+	assert.Equal("empty", name)
+	assert.Empty(attrs)
+
+	_, _, err = PeekRoot(strings.NewReader(`<!-- nothing -->`))
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+	_, _, err = PeekRoot(strings.NewReader(`<?xml version="1.0" encoding="ISO-8859-1"?><a/>`))
+	assert.ErrorContains(err, "UTF-8")
+}
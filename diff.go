@@ -0,0 +1,153 @@
+package xml2json
+
+import (
+	"sort"
+	"strconv"
+)
+
+// DiffKind is the kind of a Difference
+type DiffKind int
+
+const (
+	// Added is a node found only in the second tree
+	Added DiffKind = iota
+	// Removed is a node found only in the first tree
+	Removed
+	// Changed is a node found in both trees, with a different Data or Null
+	Changed
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	}
+	return "DiffKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Difference is a difference between two trees, found by Diff
+type Difference struct {
+	// Path is the Get path of the node, in the first tree for Removed and
+	// Changed nodes, in the second one for Added nodes
+	Path string
+	Kind DiffKind
+	// Old is the node in the first tree, nil for Added nodes, and New the node
+	// in the second tree, nil for Removed nodes. Added and removed nodes come
+	// with their whole subtree, their descendants are not reported on their own.
+	Old, New *Node
+}
+
+// Diff returns the differences between the trees a and b, nil if they are the
+// same. Repeated children are compared in order, the first with the first and
+// so on: an element inserted at the start of an array changes all the others.
+// Only the order within a label matters, as in the JSON output. Differences
+// are sorted by path, labels being visited in sorted order.
+func Diff(a, b *Node) []Difference {
+	return diff("", a, b, true, nil)
+}
+
+// DiffUnordered is like Diff, but repeated children are compared as sets:
+// children equal to one on the other side, whatever its position, are not
+// reported, and those left are compared in order. Comparing large arrays this
+// way is quadratic.
+func DiffUnordered(a, b *Node) []Difference {
+	return diff("", a, b, false, nil)
+}
+
+// diff appends to res the differences between a and b, at path
+func diff(path string, a, b *Node, ordered bool, res []Difference) []Difference {
+	switch {
+	case a == nil && b == nil:
+		return res
+	case a == nil:
+		return append(res, Difference{Path: path, Kind: Added, New: b})
+	case b == nil:
+		return append(res, Difference{Path: path, Kind: Removed, Old: a})
+	}
+
+	if a.Data != b.Data || a.Null != b.Null {
+		res = append(res, Difference{Path: path, Kind: Changed, Old: a, New: b})
+	}
+
+	labels := make([]string, 0, len(a.Children)+len(b.Children))
+	for label := range a.Children {
+		labels = append(labels, label)
+	}
+	for label := range b.Children {
+		if _, ok := a.Children[label]; !ok {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		as, bs := a.Children[label], b.Children[label]
+		step := func(i int) string {
+			s := label
+			if len(as) > 1 || len(bs) > 1 {
+				s += "[" + strconv.Itoa(i) + "]"
+			}
+			if path == "" {
+				return s
+			}
+			return path + "." + s
+		}
+
+		ai, bi := indexes(len(as)), indexes(len(bs))
+		if !ordered {
+			ai, bi = unmatched(as, bs)
+		}
+		for i := 0; i < len(ai) || i < len(bi); i++ {
+			switch {
+			case i >= len(bi):
+				res = append(res, Difference{Path: step(ai[i]), Kind: Removed, Old: as[ai[i]]})
+			case i >= len(ai):
+				res = append(res, Difference{Path: step(bi[i]), Kind: Added, New: bs[bi[i]]})
+			default:
+				res = diff(step(ai[i]), as[ai[i]], bs[bi[i]], ordered, res)
+			}
+		}
+	}
+
+	return res
+}
+
+// indexes returns 0 to n-1
+func indexes(n int) []int {
+	res := make([]int, n)
+	for i := range res {
+		res[i] = i
+	}
+	return res
+}
+
+// unmatched returns the indexes of the nodes of as and bs which are not equal,
+// as sets, to a node of the other list
+func unmatched(as, bs Nodes) ([]int, []int) {
+	matched := make([]bool, len(bs))
+	var ai []int
+	for i, a := range as {
+		found := false
+		for j, b := range bs {
+			if !matched[j] && diff("", a, b, false, nil) == nil {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			ai = append(ai, i)
+		}
+	}
+
+	var bi []int
+	for j := range bs {
+		if !matched[j] {
+			bi = append(bi, j)
+		}
+	}
+	return ai, bi
+}
@@ -0,0 +1,61 @@
+package xml2json
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDiff ensures that the differences between two trees are found with their paths
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	decode := func(s string) *Node {
+		root := &Node{}
+		assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+		return root
+	}
+
+	a := decode(`<lib id="1"><book><title>Go</title></book><book><title>C</title></book><name>City</name></lib>`)
+	assert.Nil(Diff(a, a))
+	assert.Nil(Diff(a, decode(`<lib id="1"><name>City</name><book><title>Go</title></book><book><title>C</title></book></lib>`)))
+
+	b := decode(`<lib id="2"><book><title>Go</title><year>2015</year></book><book><title>Rust</title></book><book><title>C</title></book></lib>`)
+	diffs := Diff(a, b)
+
+	type summary struct {
+		Path string
+		Kind DiffKind
+	}
+	var got []summary
+	for _, d := range diffs {
+		got = append(got, summary{d.Path, d.Kind})
+	}
+	assert.Equal([]summary{
+		{"lib.-id", Changed},
+		{"lib.book[0].year", Added},
+		{"lib.book[1].title", Changed},
+		{"lib.book[2]", Added},
+		{"lib.name", Removed},
+	}, got)
+
+	assert.Equal("1", diffs[0].Old.Data)
+	assert.Equal("2", diffs[0].New.Data)
+	assert.Nil(diffs[1].Old)
+	assert.Equal("2015", diffs[1].New.Data)
+	assert.Equal("C", diffs[3].New.Get("title")[0].Data)
+	assert.Equal("City", a.Get(diffs[4].Path)[0].Data)
+
+	// As sets, only the inserted book is reported
+	c := decode(`<lib id="1"><book><title>Rust</title></book><book><title>C</title></book><book><title>Go</title></book><name>City</name></lib>`)
+	assert.Len(Diff(a, c), 2)
+	diffs = DiffUnordered(a, c)
+	assert.Len(diffs, 1)
+	assert.Equal(Added, diffs[0].Kind)
+	assert.Equal("lib.book[0]", diffs[0].Path)
+	assert.Equal("removed", Removed.String())
+
+	assert.Equal([]Difference{{Kind: Added, New: a}}, Diff(nil, a))
+	assert.Equal([]Difference{{Kind: Changed, Old: &Node{}, New: &Node{Null: true}}}, Diff(&Node{}, &Node{Null: true}))
+}
@@ -1,157 +1,2719 @@
 package xml2json
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	hexenc "encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math"
+	"os"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
 	"unicode/utf8"
 )
 
+// ErrNotFound is returned when a path does not select any node
+var ErrNotFound = errors.New("xml2json: not found")
+
+// SortOrder is the order in which the keys of an object are written
+type SortOrder int
+
+const (
+	// Ascending sorts the keys, it is the default
+	Ascending SortOrder = iota
+	// Descending sorts the keys in reverse order
+	Descending
+	// None keeps the keys in the order their children were added
+	None
+)
+
+// ErrMaxEncodeDepth is returned when a tree is nested deeper than the limit of
+// SetMaxEncodeDepth
+var ErrMaxEncodeDepth = errors.New("xml2json: maximum encode depth exceeded")
+
+// ErrEmptyRoot is returned with NilRootReturnError when the root to encode is
+// nil or empty
+var ErrEmptyRoot = errors.New("xml2json: nil or empty root")
+
+// NilRootBehavior is what Encode writes for a nil root, or an empty one: not
+// null, without data nor children, as decoded from a document without element
+type NilRootBehavior int
+
+const (
+	// NilRootWriteNothing writes nothing for a nil root and "" for an empty
+	// one, it is the default
+	NilRootWriteNothing NilRootBehavior = iota
+	// NilRootWriteNull writes null
+	NilRootWriteNull
+	// NilRootWriteEmptyObject writes {}
+	NilRootWriteEmptyObject
+	// NilRootReturnError writes nothing and returns ErrEmptyRoot
+	NilRootReturnError
+)
+
+// RootAttributePolicy is where the attributes of the root element go when
+// Encoder.SetIncludeRoot(false) unwraps it
+type RootAttributePolicy int
+
+const (
+	// RootAttributesPromote writes them among the keys of the top-level
+	// object, with their prefix, as they are written on any element:
+	// {"-version": "2", "item": ...}. It is the default.
+	RootAttributesPromote RootAttributePolicy = iota
+	// RootAttributesDrop leaves them out
+	RootAttributesDrop
+	// RootAttributesNest writes them, with their prefix, in an object under
+	// the "_root" key of the top-level object: {"_root": {"-version": "2"},
+	// "item": ...}
+	RootAttributesNest
+)
+
+// rootAttributesKey is the key of the attributes of RootAttributesNest
+const rootAttributesKey = "_root"
+
+// ValueKind is the kind of a JSON value, see Encoder.SetOnEmit
+type ValueKind int
+
+const (
+	// ValueObject is a JSON object
+	ValueObject ValueKind = iota
+	// ValueArray is a JSON array
+	ValueArray
+	// ValueString is a JSON string
+	ValueString
+	// ValueNumber is a JSON number
+	ValueNumber
+	// ValueBool is true or false
+	ValueBool
+	// ValueNull is null
+	ValueNull
+)
+
+func (k ValueKind) String() string {
+	switch k {
+	case ValueObject:
+		return "object"
+	case ValueArray:
+		return "array"
+	case ValueString:
+		return "string"
+	case ValueNumber:
+		return "number"
+	case ValueBool:
+		return "bool"
+	case ValueNull:
+		return "null"
+	}
+	return "ValueKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// MixedContentArrayShape is how arrays of repeated elements are written when
+// some of them have both text and children, see
+// Encoder.SetMixedContentArrayShape
+type MixedContentArrayShape int
+
+const (
+	// MixedArrayAsIs writes each element as it would be written alone: an
+	// object for those with children, with their text under the content key,
+	// and a string for the text-only ones, e.g. ["plain", {"#content": "text",
+	// "b": "bold"}]. It is the default.
+	MixedArrayAsIs MixedContentArrayShape = iota
+	// MixedArrayObjects writes every element as an object, so that the items
+	// all have the same shape: the text of text-only elements goes under the
+	// key used for the text of the others, [{"#content": "plain"},
+	// {"#content": "text", "b": "bold"}], empty ones included. Only null
+	// elements are still written as null.
+	MixedArrayObjects
+)
+
+// Dialect is the flavour of JSON written by the encoder
+type Dialect int
+
+const (
+	// DialectJSON writes standard JSON, it is the default
+	DialectJSON Dialect = iota
+	// DialectJSON5 writes JSON5 (https://json5.org): the keys which are
+	// identifiers are not quoted and, when indenting, the last member of each
+	// multi-line object or array is followed by a comma. This is not JSON:
+	// encoding/json, and most JSON parsers, reject it.
+	DialectJSON5
+)
+
+// ErrKeyClash is returned with the ClashError policy when an attribute and an
+// element end up with the same key
+var ErrKeyClash = errors.New("xml2json: key clash")
+
+// KeyClashPolicy is what the encoder does when an attribute and an element of
+// the same node have the same label, which happens when the attribute prefix is
+// empty: <a id="1"><id>2</id></a>
+type KeyClashPolicy int
+
+const (
+	// ClashMergeIntoArray encodes both as a single array, it is the default
+	ClashMergeIntoArray KeyClashPolicy = iota
+	// ClashSuffixAttribute adds attrClashSuffix to the key of the attributes
+	ClashSuffixAttribute
+	// ClashError makes the encoding fail with ErrKeyClash
+	ClashError
+)
+
+// AttributedScalarLayout is how the encoder writes the elements which have
+// attributes and text but no child element, <price currency="USD">9.99</price>
+type AttributedScalarLayout int
+
+const (
+	// AttributedScalarNested writes them as other elements with attributes,
+	// it is the default: {"price": {"#content": "9.99", "-currency": "USD"}}
+	AttributedScalarNested AttributedScalarLayout = iota
+	// AttributedScalarCompact writes the attributes without their prefix and
+	// the text under the key of SetMixedContentKey, "_" if it is not set:
+	// {"price": {"_": "9.99", "currency": "USD"}}
+	AttributedScalarCompact
+	// AttributedScalarPromoted writes the text as the value of the element
+	// and each attribute as a sibling key, the label of the element and the
+	// name of the attribute joined by promotedAttrSep, right after it:
+	// {"price": "9.99", "price_currency": "USD"}. Repeated elements, and
+	// those forced into arrays, use AttributedScalarCompact instead.
+	AttributedScalarPromoted
+)
+
+// ArrayWrapperStyle is how the encoder writes the elements which have
+// repeated children, <list><item>a</item><item>b</item></list>
+type ArrayWrapperStyle int
+
+const (
+	// ArrayMerged groups repeated children into an array under their label,
+	// it is the default: {"list": {"item": ["a", "b"]}}
+	ArrayMerged ArrayWrapperStyle = iota
+	// ArrayWrapped writes the element as an array of single-key objects, one
+	// per child, so that every entry keeps its name:
+	// {"list": [{"item": "a"}, {"item": "b"}]}. The text and attributes of the
+	// element get an entry too, first, and the children follow the key order.
+	// Elements without repeated children are still written as objects.
+	ArrayWrapped
+)
+
+// BinaryEncoding is the encoding of binary content, see SetBinaryElements
+type BinaryEncoding int
+
+const (
+	// HexBinary is the hexadecimal encoding of xsd:hexBinary
+	HexBinary BinaryEncoding = iota
+	// Base64Binary is the standard base64 encoding of xsd:base64Binary
+	Base64Binary
+)
+
+// promotedAttrSep joins element labels and attribute names with
+// AttributedScalarPromoted
+const promotedAttrSep = "_"
+
+// attrClashSuffix is added to attribute keys with ClashSuffixAttribute
+const attrClashSuffix = "_attr"
+
 // An Encoder writes JSON objects to an output stream.
 type Encoder struct {
-	w               io.Writer
-	err             error
-	contentPrefix   string
-	attributePrefix string
-	indent          bool
-	indentText      string
+	w                  io.Writer
+	err                error
+	contentPrefix      string
+	attributePrefix    string
+	indent             bool
+	indentText         string
+	linePrefix         string
+	forceArray         map[string]bool
+	forceArrayRe       *regexp.Regexp
+	dedupeArrays       bool
+	sanitizeKeys       bool
+	sortOrder          SortOrder
+	keyClash           KeyClashPolicy
+	smartPrefix        bool
+	envelope           map[string]interface{}
+	envelopeKey        string
+	inferTypes         bool
+	numberFormat       func(raw string) (string, bool)
+	arrayLimit         int
+	truncationSuffix   string
+	collapseSingletons bool
+	arrayKey           func(i int, n *Node) string
+	asciiOnly          bool
+	inferAttrTypes     bool
+	homogeneous        bool
+	rootKey            string
+	rootKeyWrap        bool
+	contentKeyName     string
+	mixedContentKey    string
+	minimalSeps        bool
+	separateText       bool
+	groupByLang        bool
+	wrapScalarRoot     bool
+	maxDepth           int
+	depth              int
+	elementEncoders    map[string]func(n *Node) (json.RawMessage, error)
+	attributedScalar   AttributedScalarLayout
+	out                io.Writer // w as given, which Flush flushes
+	flushEvery         int
+	unflushed          int
+	omitEmpty          bool
+	omitEmptyContent   bool
+	itemsPerLine       int
+	tokenAttrs         map[string]bool
+	singleTokenScalar  bool
+	mongo              bool
+	mongoDateLayouts   []string
+	wrapperStyle       ArrayWrapperStyle
+	floatFmt           byte
+	floatPrec          int
+	nilRoot            NilRootBehavior
+	groupConsecutive   bool
+	attrKeyFunc        func(name string) string
+	binaryElements     map[string]BinaryEncoding
+	dialect            Dialect
+	onEmit             func(path []string, key string, kind ValueKind)
+	emitPath           []string
+	emitPending        bool
+	keyRename          map[string]string
+	resultKey          string
+	annotateAmbiguous  bool
+	arrayFlushEvery    int
+	arrayStreamThresh  int
+	pathKey            string
+	joins              map[string]joinSpec
+	warnings           []string
+	strBuf             bytes.Buffer // reused by writeQuoted
+	mixedArrayShape    MixedContentArrayShape
+	emptyAttrAsTrue    bool
+	attrGroups         []string
+	dateLayouts        []string
+	dateOutput         string
+	omitRoot           bool
+	sortScalarArrays   bool
+	rootAttrPolicy     RootAttributePolicy
+}
+
+// joinSpec is the child and separator of an element of SetJoinChildren
+type joinSpec struct {
+	child string
+	sep   string
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:               w,
+		out:             w,
+		contentPrefix:   contentPrefix,
+		attributePrefix: attrPrefix,
+		indent:          false,
+		indentText:      "",
+		envelopeKey:     "data",
+	}
+}
+
+// SetArrayFlushEvery makes the encoder call Flush after every n items of each
+// array, and at the end of each value, so that the output of a huge array goes
+// out as it is written rather than piling up in a buffering writer. Items are
+// counted per array, nested arrays apart. 0, the default, never flushes. It
+// combines with SetAutoFlush, which counts bytes instead.
+func (enc *Encoder) SetArrayFlushEvery(n int) *Encoder {
+	enc.arrayFlushEvery = n
+	return enc
+}
+
+// SetArrayStreamThreshold makes the encoder stream the arrays that have more
+// than n items: once n items of such an array are written, it calls Flush, and
+// then again after each further item, so a buffering writer never holds more
+// than n items of one array. Shorter arrays, and the end of each value, are
+// flushed as usual. 0, the default, turns it off.
+func (enc *Encoder) SetArrayStreamThreshold(n int) *Encoder {
+	enc.arrayStreamThresh = n
+	return enc
+}
+
+// SetAutoFlush makes the encoder call Flush every n bytes written, and at the
+// end of each value, so that a reader at the other end sees progress on long
+// outputs. 0, the default, never flushes. The encoder does not buffer by
+// itself: this is meant for writers which do, such as a *bufio.Writer or an
+// http.ResponseWriter, whose http.Flusher sends the response written so far to
+// the client.
+func (enc *Encoder) SetAutoFlush(n int) *Encoder {
+	enc.flushEvery = n
+	return enc
+}
+
+// Flush flushes the output writer, when it has a Flush method: Flush() error
+// like *bufio.Writer or Flush() like http.Flusher. Other writers are left
+// alone.
+func (enc *Encoder) Flush() error {
+	enc.unflushed = 0
+	switch f := enc.out.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
+
+// Reset makes the encoder write to w and clears any previous error, so that a
+// configured encoder can be reused. It does not change any option.
+func (enc *Encoder) Reset(w io.Writer) {
+	enc.w = w
+	enc.out = w
+	enc.unflushed = 0
+	enc.err = nil
+	enc.warnings = nil
+}
+
+// Warnings returns the problems which did not stop the encoding, such as
+// elements SetJoinChildren could not join, met since the encoder was created or
+// last Reset
+func (enc *Encoder) Warnings() []string {
+	return enc.warnings
+}
+
+// Marshal returns the JSON encoding of root as the default Encoder writes it,
+// without indentation but with a space after commas and colons, and without
+// the trailing newline. See Compact for the spacing of json.Marshal.
+func Marshal(root *Node) ([]byte, error) {
+	return marshal(NewEncoder(nil), root)
+}
+
+// Compact returns the densest JSON encoding of root: no indentation and no
+// space after separators, like json.Marshal.
+func Compact(root *Node) string {
+	b, _ := marshal(NewEncoder(nil).SetMinimalSeparators(true), root)
+	return string(b)
+}
+
+// EncodeCanonical returns a deterministic JSON encoding of root, whatever the
+// options of any encoder, for hashing or signing. The rules are:
+//   - the content key comes first, then keys sorted by their bytes;
+//   - no whitespace outside strings and no trailing newline;
+//   - strings escaped like json.Marshal does: quote, backslash, newline,
+//     carriage return and tab with a backslash, the other control
+//     characters, '<', '>', '&', U+2028 and U+2029 as 4-digit hex escapes and
+//     invalid UTF-8 as U+FFFD; other characters are written as UTF-8;
+//   - the text of elements inferred as by SetInferTypes, attributes kept as
+//     strings;
+//   - integers written as is except "-0" which is 0, other numbers in their
+//     shortest form which parses back to the same float64, with an
+//     exponent only below 1e-6 or from 1e21, like JavaScript; numbers out of
+//     the float64 range are written as strings.
+func EncodeCanonical(root *Node) ([]byte, error) {
+	enc := NewEncoder(nil).SetMinimalSeparators(true).SetSortOrder(Ascending).
+		SetInferTypes(true).SetNumberFormat(canonicalNumber)
+	return marshal(enc, root)
+}
+
+// canonicalNumber is the number format of EncodeCanonical
+func canonicalNumber(raw string) (string, bool) {
+	if strings.Trim(raw, "-0123456789") == "" {
+		if raw == "-0" {
+			return "0", true
+		}
+		return raw, true
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return "", false
+	}
+	if f == 0 {
+		return "0", true
+	}
+	if abs := math.Abs(f); abs < 1e-6 || abs >= 1e21 {
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		if i := len(s) - 2; s[i] == '0' && (s[i-1] == '-' || s[i-1] == '+') {
+			s = s[:i] + s[i+1:]
+		}
+		return s, true
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), true
+}
+
+// An Option configures an Encoder, for the functions which create their own.
+type Option func(enc *Encoder)
+
+// WithIndent is the Option calling SetIndent.
+func WithIndent(indent string) Option {
+	return func(enc *Encoder) { enc.SetIndent(indent) }
+}
+
+// WithContentKey is the Option calling SetContentKey.
+func WithContentKey(name string) Option {
+	return func(enc *Encoder) { enc.SetContentKey(name) }
+}
+
+// WithInferTypes is the Option calling SetInferTypes.
+func WithInferTypes(b bool) Option {
+	return func(enc *Encoder) { enc.SetInferTypes(b) }
+}
+
+// EstimateSize returns about how many bytes encoding root with the given
+// options writes, without encoding it, e.g. to size a buffer or reject a large
+// document early. It accounts for keys, separators, indentation and type
+// inference, but not for escaping, which makes strings longer, nor for the
+// options which reshape the output.
+func EstimateSize(root *Node, opts ...Option) int {
+	if root == nil {
+		return 0
+	}
+	enc := NewEncoder(nil)
+	for _, opt := range opts {
+		opt(enc)
+	}
+	return enc.estimate(root, 0) + len("\n")
+}
+
+// EncodeToFile encodes root with the given options into the file at path,
+// created or truncated, through a buffered writer. The error of the final
+// flush and that of closing the file are returned too, as either means the
+// file may be incomplete.
+func EncodeToFile(path string, root *Node, opts ...Option) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	enc := NewEncoder(w)
+	for _, opt := range opts {
+		opt(enc)
+	}
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// estimate returns the approximate length of the encoding of n at level lvl
+func (enc *Encoder) estimate(n *Node, lvl int) int {
+	if n.Null {
+		return len("null")
+	}
+	if !n.HasChildren() {
+		return enc.estimateScalar(n.Data, enc.infers(n))
+	}
+
+	keySep := len(enc.key("")) - len(`""`)
+	line := 0
+	size := len("{}")
+	if enc.indent {
+		line = len(enc.linePrefix) + (lvl+1)*len(enc.indentText)
+		size += 2*len("\n") + len(enc.linePrefix) + lvl*len(enc.indentText)
+	}
+
+	count := 0
+	if n.Data != "" {
+		size += line + len(enc.contentKey(n)) + 2 + keySep + enc.estimateScalar(n.Data, enc.infers(n))
+		count++
+	}
+	for label, children := range n.Children {
+		size += line + len(label) + 2 + keySep
+		if len(children) == 1 {
+			size += enc.estimate(children[0], lvl+1)
+		} else {
+			size += len("[]") + (len(children)-1)*len(enc.itemSep())
+			for _, c := range children {
+				size += enc.estimate(c, lvl+2)
+			}
+		}
+		count++
+	}
+	return size + (count-1)*len(enc.comma())
+}
+
+// estimateScalar returns the length of the encoding of data, without escapes
+func (enc *Encoder) estimateScalar(data string, infer bool) int {
+	if infer && (isNumber(data) || data == "true" || data == "false" || data == "null") {
+		return len(data)
+	}
+	return len(data) + 2
+}
+
+// MarshalIndent is like Marshal but applies indentation to format the output,
+// like json.MarshalIndent. Each line after the first begins with prefix
+// followed by one or more copies of indent according to the nesting.
+func MarshalIndent(root *Node, prefix, indent string) ([]byte, error) {
+	return marshal(NewEncoder(nil).SetIndent(indent).SetLinePrefix(prefix), root)
+}
+
+// marshal encodes root with enc into a buffer, without the trailing newline
+func marshal(enc *Encoder, root *Node) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc.w = buf
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (enc *Encoder) SetAttributePrefix(prefix string) *Encoder {
+	enc.attributePrefix = prefix
+	return enc
+}
+
+func (enc *Encoder) SetContentPrefix(prefix string) *Encoder {
+	enc.contentPrefix = prefix
+	return enc
+}
+
+// SetContentKey sets the key of the text of elements written as objects,
+// replacing the content prefix followed by "content" ("#content" by default).
+func (enc *Encoder) SetContentKey(name string) *Encoder {
+	enc.contentKeyName = name
+	return enc
+}
+
+// SetMixedContentKey sets the key of the text of elements which also have
+// attributes or child elements, e.g. "_" while leaves use "#text". It takes
+// precedence over SetContentKey for those elements; for the others, the key of
+// SetContentKey or the default one is kept.
+func (enc *Encoder) SetMixedContentKey(name string) *Encoder {
+	enc.mixedContentKey = name
+	return enc
+}
+
+// SetOmitEmpty leaves out empty elements, with their key: those which have
+// no text, no attribute and only empty child elements, so that omitting
+// children can make their parent empty too. Attributes are never empty, even
+// with an empty value, nor are null nodes. Empty elements are dropped from
+// arrays as well; a document with only empty elements is written as {}.
+func (enc *Encoder) SetOmitEmpty(b bool) *Encoder {
+	enc.omitEmpty = b
+	return enc
+}
+
+// SetOmitEmptyContent leaves out the content key of the elements which have
+// children and whose text is only whitespace, such as the indentation kept by
+// xml:space="preserve". The element itself is kept, unlike with SetOmitEmpty,
+// and so is the whitespace text of elements without children. Under
+// xml:space="preserve" (Node.Preserved), whitespace is only left out from
+// elements with child elements: in elements with attributes only, it is the
+// value itself.
+func (enc *Encoder) SetOmitEmptyContent(b bool) *Encoder {
+	enc.omitEmptyContent = b
+	return enc
+}
+
+// SetSeparateTextAndChildren writes every element as an object, text-only
+// elements included: <a>x</a> gives {"a": {"#content": "x"}} and <a/> gives
+// {"a": {}}. Consumers then never have to tell a string from an object.
+// Attribute values are still written as scalars.
+func (enc *Encoder) SetSeparateTextAndChildren(b bool) *Encoder {
+	enc.separateText = b
+	return enc
+}
+
+// SetMinimalSeparators removes the space written after commas and colons,
+// for the smallest output, like json.Marshal
+func (enc *Encoder) SetMinimalSeparators(b bool) *Encoder {
+	enc.minimalSeps = b
+	return enc
+}
+
+func (enc *Encoder) SetIndent(s string) *Encoder {
+	enc.indent = true
+	enc.indentText = s
+	return enc
+}
+
+// SetEnvelope wraps the document in an object holding the given metadata,
+// e.g. {"$schema": "...", "data": {...}}. The metadata keys are written first,
+// in sorted order, and their values are encoded with encoding/json. The
+// document goes under the key set with SetEnvelopeKey, "data" by default.
+// A nil map removes the envelope.
+func (enc *Encoder) SetEnvelope(meta map[string]interface{}) *Encoder {
+	enc.envelope = meta
+	return enc
+}
+
+// SetEnvelopeKey sets the key of the document in the envelope
+func (enc *Encoder) SetEnvelopeKey(key string) *Encoder {
+	enc.envelopeKey = key
+	return enc
+}
+
+// SetInferTypes makes text that is a valid JSON number, true, false or null
+// encode as such instead of as a string. Numbers with a leading zero, like
+// "007", are not valid JSON numbers and stay strings. Attribute values are
+// only inferred with SetInferAttributeTypes.
+func (enc *Encoder) SetInferTypes(b bool) *Encoder {
+	enc.inferTypes = b
+	return enc
+}
+
+// SetAnnotateAmbiguousTypes makes the values which look like numbers, but are
+// kept as strings, encode as {"$string": "007"} rather than "007", so that
+// type-aware consumers know the string was deliberate. These are the numbers
+// with leading zeros, which are not valid JSON, and the integers beyond 2^53,
+// which a float64 does not hold exactly: with this option, they are no longer
+// inferred as numbers. Only values subject to type inference are annotated,
+// see SetInferTypes and SetInferAttributeTypes; SetMongoExtendedJSON takes
+// precedence for the large integers.
+func (enc *Encoder) SetAnnotateAmbiguousTypes(b bool) *Encoder {
+	enc.annotateAmbiguous = b
+	return enc
+}
+
+// SetInferAttributeTypes applies the same inference as SetInferTypes to the
+// values of attributes (nodes with IsAttribute set). It is separate because
+// attributes often hold codes which must stay strings.
+func (enc *Encoder) SetInferAttributeTypes(b bool) *Encoder {
+	enc.inferAttrTypes = b
+	return enc
+}
+
+// SetHomogeneousArrays keeps all the values of an array as strings when type
+// inference would give them different types, e.g. ["1", "abc"] rather than
+// [1, "abc"]. Consumers get arrays of a single type, at the cost of losing
+// the inferred types of the whole array because of one odd value. null counts
+// as a type of its own; objects in arrays are not taken into account.
+func (enc *Encoder) SetHomogeneousArrays(b bool) *Encoder {
+	enc.homogeneous = b
+	return enc
+}
+
+// SetNumberFormat sets a function called with each number recognized by type
+// inference, of elements or attributes, to reformat it (e.g. always with two
+// decimals). It returns the number to write, which must be valid JSON number
+// syntax as it is written as is, or false to keep the original text as a
+// string. An empty number also keeps the original text.
+func (enc *Encoder) SetNumberFormat(fn func(raw string) (string, bool)) *Encoder {
+	enc.numberFormat = fn
+	return enc
+}
+
+// SetMongoExtendedJSON writes the values which JSON cannot carry faithfully
+// with MongoDB extended JSON wrappers, for mongoimport:
+//   - {"$numberLong": "..."} for integers inferred by SetInferTypes beyond
+//     2^53-1 in absolute value, which lose precision as JSON numbers, and
+//     {"$numberDecimal": "..."} for those which do not even fit in 64 bits;
+//   - {"$date": "..."} for the text of elements and attributes which is a
+//     date in one of the layouts of SetMongoDateLayouts, RFC 3339 or
+//     "2006-01-02" by default, written in RFC 3339 in UTC.
+func (enc *Encoder) SetMongoExtendedJSON(b bool) *Encoder {
+	enc.mongo = b
+	return enc
+}
+
+// SetMongoDateLayouts sets the time.Parse layouts of the dates wrapped in
+// {"$date": ...} by SetMongoExtendedJSON. No layout disables the wrapping.
+func (enc *Encoder) SetMongoDateLayouts(layouts ...string) *Encoder {
+	enc.mongoDateLayouts = append([]string{}, layouts...)
+	return enc
+}
+
+// SetNormalizeDates rewrites the leaf values, element texts and attribute
+// values, which parse with one of the time.Parse inputLayouts, tried in order,
+// as formatted with the output layout, e.g. time.RFC3339. Other values are
+// written as they are. Dates are rewritten ahead of type inference, so a
+// layout such as "20060102" wins over the number the value would be inferred
+// as. No layout disables the rewriting.
+func (enc *Encoder) SetNormalizeDates(inputLayouts []string, output string) *Encoder {
+	enc.dateLayouts = append([]string{}, inputLayouts...)
+	enc.dateOutput = output
+	return enc
+}
+
+// SetSortScalarArrays writes the arrays of scalar values sorted by value
+// rather than in document order. Values are compared as numbers when type
+// inference applies to all of them and they all are numbers, and as strings,
+// byte-wise, otherwise: ["10", "9"] but [9, 10]. null values come first.
+// Arrays holding an object, or written by an element encoder, are left as
+// they are. Sorting happens before SetArrayLimit truncates the array.
+func (enc *Encoder) SetSortScalarArrays(b bool) *Encoder {
+	enc.sortScalarArrays = b
+	return enc
+}
+
+// SetArrayWrapperStyle sets how elements with repeated children are written,
+// see ArrayWrapperStyle.
+func (enc *Encoder) SetArrayWrapperStyle(style ArrayWrapperStyle) *Encoder {
+	enc.wrapperStyle = style
+	return enc
+}
+
+// SetGroupConsecutiveOnly only groups repeated elements into an array when
+// they are adjacent. An element whose children interleave, as in
+// <p><a/><b/><a/></p>, is then written as an array of single-key objects, one
+// per run of children with the same name, in document order:
+// {"p": [{"a": ""}, {"b": ""}, {"a": ""}]}. Its text, if any, comes first as
+// a content entry. Other elements are written as usual.
+func (enc *Encoder) SetGroupConsecutiveOnly(b bool) *Encoder {
+	enc.groupConsecutive = b
+	return enc
+}
+
+// SetArrayItemsPerLine writes arrays on several lines when indenting, with at
+// most n scalars per line; objects in arrays still get a line each. 0, the
+// default, keeps arrays on one line, as well as every array when not
+// indenting.
+func (enc *Encoder) SetArrayItemsPerLine(n int) *Encoder {
+	enc.itemsPerLine = n
+	return enc
+}
+
+// SetDialect sets the flavour of JSON written, DialectJSON by default. The
+// output of DialectJSON5 is meant to be read by people, or by JSON5 parsers: it
+// won't parse with encoding/json.
+func (enc *Encoder) SetDialect(d Dialect) *Encoder {
+	enc.dialect = d
+	return enc
+}
+
+// SetOnEmit makes the encoder call fn as it writes each member of the JSON
+// objects, when the value starts: path holds the keys of the enclosing members
+// from the top of the output, with the index in brackets of the array item
+// they are in, if any, e.g. ["catalog", "book[1]"], and kind is the kind of the
+// value. The root value, having no key, is not reported, nor are items of
+// arrays themselves. The path slice is reused and is only valid during the
+// call.
+//
+// fn is called on the hot path of the encoder: it must be fast, and is best
+// left unset outside debugging. nil, the default, calls nothing.
+func (enc *Encoder) SetOnEmit(fn func(path []string, key string, kind ValueKind)) *Encoder {
+	enc.onEmit = fn
+	return enc
+}
+
+// SetJoinChildren makes the elements named elementName, whose children are all
+// childName elements with text only, encode as the string of their texts
+// joined with sep: <tags><t>a</t><t>b</t></tags> gives {"tags": "a,b"} with
+// ("tags", "t", ","). Elements with anything else, such as attributes, text,
+// other children, or children with attributes or children of their own, are
+// encoded as usual, with a warning, see Warnings. Element encoders take
+// precedence.
+func (enc *Encoder) SetJoinChildren(elementName, childName, sep string) *Encoder {
+	if enc.joins == nil {
+		enc.joins = map[string]joinSpec{}
+	}
+	enc.joins[elementName] = joinSpec{child: childName, sep: sep}
+	return enc
+}
+
+// SetEmitPath adds a member with the given key first in each object holding
+// the children of an element, whose value is the path of the object from the
+// top of the output: the keys leading to it separated by dots, with the index
+// in brackets of the array items, e.g. "catalog.book[1]". The object of the
+// whole document, having no key, gets none. This inflates the output and is
+// meant for search indexing, where each object must be found back on its own.
+// An empty key, the default, adds nothing.
+func (enc *Encoder) SetEmitPath(key string) *Encoder {
+	enc.pathKey = key
+	return enc
+}
+
+// SetFloatFormat reformats the numbers with a fraction or an exponent found
+// by type inference, as strconv.FormatFloat does with fmt and prec: 'f' for
+// no exponent, 'e' for one and 'g' for the shortest of both, prec being the
+// number of digits (-1 for as few as needed). Integers, and numbers out of the
+// float64 range, are written as in the document, and SetNumberFormat, if set,
+// takes precedence. Values which are not inferred are never reformatted.
+func (enc *Encoder) SetFloatFormat(fmt byte, prec int) *Encoder {
+	enc.floatFmt = fmt
+	enc.floatPrec = prec
+	return enc
+}
+
+// SetArrayLimit makes arrays encode at most their first n elements, 0 meaning
+// no limit. The output is then lossy: it is meant for previews and logs, not
+// for round-tripping. Duplicates dropped by SetDedupeArrayElements go first
+// and do not count towards n. See SetArrayTruncationSuffix to flag truncated
+// arrays.
+func (enc *Encoder) SetArrayLimit(n int) *Encoder {
+	enc.arrayLimit = n
+	return enc
+}
+
+// SetArrayTruncationSuffix makes each array truncated by SetArrayLimit be
+// followed by a sibling key, its label with suffix appended, holding the number
+// of elements before truncation: {"item": [...], "item_truncated": 250}.
+func (enc *Encoder) SetArrayTruncationSuffix(suffix string) *Encoder {
+	enc.truncationSuffix = suffix
+	return enc
+}
+
+// SetCollapseSingletonArrays writes arrays left with a single element, e.g.
+// by SetDedupeArrayElements or SetArrayLimit, as that element alone. Labels
+// forced into arrays by SetForceArray or SetForceArrayPattern always stay
+// arrays, force wins. For a label which is not forced:
+//
+//	elements in the document   after dedupe/limit   output
+//	1                          1                    value
+//	2 or more                  2 or more            array
+//	2 or more                  1                    array, or value when set
+func (enc *Encoder) SetCollapseSingletonArrays(b bool) *Encoder {
+	enc.collapseSingletons = b
+	return enc
+}
+
+// SetArrayAsObject writes repeated elements as an object instead of an array,
+// keyed by keyFunc for each element given its index in the array, e.g.
+// {"book": {"b1": {...}, "b2": {...}}}. This changes the shape of the output
+// and replaces every array, so it is not meant to be used with SetForceArray:
+// forced labels then give single-key objects. keyFunc must return distinct
+// keys for the elements of a same array.
+func (enc *Encoder) SetArrayAsObject(keyFunc func(i int, n *Node) string) *Encoder {
+	enc.arrayKey = keyFunc
+	return enc
+}
+
+// SetElementEncoder makes the elements with label name be written as the JSON
+// returned by fn, e.g. to turn a date into an object or hex data into base64.
+// fn takes precedence over every option about the value of the element, type
+// inference included; errors it returns, and invalid JSON, abort Encode. The
+// JSON is written as is, so it is not indented.
+func (enc *Encoder) SetElementEncoder(name string, fn func(n *Node) (json.RawMessage, error)) *Encoder {
+	if enc.elementEncoders == nil {
+		enc.elementEncoders = map[string]func(n *Node) (json.RawMessage, error){}
+	}
+	enc.elementEncoders[name] = fn
+	return enc
+}
+
+// SetAttributeAsArray makes the attributes with the given name, without
+// prefix, be written as the array of their whitespace-separated tokens, e.g.
+// class="a b c" gives ["a", "b", "c"]. An empty value gives [], and a single
+// token a single-element array, unless SetSingleTokenScalar is set. With
+// SetInferAttributeTypes, each token is inferred on its own: flags="true 0"
+// gives [true, 0].
+func (enc *Encoder) SetAttributeAsArray(attrName string) *Encoder {
+	if enc.tokenAttrs == nil {
+		enc.tokenAttrs = map[string]bool{}
+	}
+	enc.tokenAttrs[attrName] = true
+	return enc
+}
+
+// SetEmptyAttributeAsTrue writes the attributes with an empty value as true
+// rather than "", as HTML boolean attributes: disabled="" gives
+// {"-disabled": true}. So are those whose value is their own name, such as
+// disabled="disabled", which is also what SetLenient decodes a bare <input
+// disabled> into. This is off by default, as it is lossy for attributes which
+// are empty, or hold their name, for other reasons.
+func (enc *Encoder) SetEmptyAttributeAsTrue(b bool) *Encoder {
+	enc.emptyAttrAsTrue = b
+	return enc
+}
+
+// SetAttributeGroup collects the attributes named prefix followed by an index,
+// such as opt1="a" opt2="b" opt3="c", into a single array under the key of an
+// attribute named prefix: {"-opt": ["a", "b", "c"]}. Items are in the order of
+// the indices, numerically; gaps are closed up, so opt1 and opt3 give two
+// items. Attributes with other suffixes, like optX, are left alone; so is the
+// whole group when an attribute is named prefix itself. A group of a single
+// attribute still is an array.
+func (enc *Encoder) SetAttributeGroup(prefix string) *Encoder {
+	enc.attrGroups = append(enc.attrGroups, prefix)
+	return enc
+}
+
+// SetSingleTokenScalar writes the attributes of SetAttributeAsArray which have
+// a single token as that token rather than as an array, class="a" giving "a".
+func (enc *Encoder) SetSingleTokenScalar(b bool) *Encoder {
+	enc.singleTokenScalar = b
+	return enc
+}
+
+// SetBinaryElements makes the text of the elements with the given names, which
+// is binary content in the from encoding, be written in the other one: hex
+// becomes base64 and base64 becomes lowercase hex. Whitespace in the text, such
+// as line breaks in long base64, is ignored. Malformed content makes Encode
+// fail.
+func (enc *Encoder) SetBinaryElements(from BinaryEncoding, names ...string) *Encoder {
+	if enc.binaryElements == nil {
+		enc.binaryElements = map[string]BinaryEncoding{}
+	}
+	for _, name := range names {
+		enc.binaryElements[name] = from
+	}
+	return enc
+}
+
+// SetGroupByLang writes repeated elements which all have a distinct xml:lang
+// attribute as an object keyed by language, e.g. {"title": {"en": "Hi", "fr":
+// "Salut"}}, without the attribute. If any of them has no xml:lang, or two
+// share one, they are written as usual so that nothing is lost; so are single
+// elements.
+func (enc *Encoder) SetGroupByLang(b bool) *Encoder {
+	enc.groupByLang = b
+	return enc
+}
+
+// SetASCIIOnly escapes every non-ASCII character of strings and keys as
+// \uXXXX, using surrogate pairs beyond the Basic Multilingual Plane, so that
+// the output is pure ASCII, the values of SetEnvelope included.
+func (enc *Encoder) SetASCIIOnly(b bool) *Encoder {
+	enc.asciiOnly = b
+	return enc
+}
+
+// SetMixedContentArrayShape sets how arrays of repeated elements are written
+// when at least one of them has both text and child elements (attributes
+// included), see MixedContentArrayShape. Whatever the shape, the text of an
+// element with children is the last non-empty run of text between them.
+func (enc *Encoder) SetMixedContentArrayShape(shape MixedContentArrayShape) *Encoder {
+	enc.mixedArrayShape = shape
+	return enc
+}
+
+// SetWrapScalarRoot makes the output an object when the encoded node is a
+// scalar, e.g. a text-only element: {"#content": "value"} rather than the bare
+// "value" written by default. The key is the one of SetContentKey; use
+// SetRootKey instead for another one.
+func (enc *Encoder) SetWrapScalarRoot(b bool) *Encoder {
+	enc.wrapScalarRoot = b
+	return enc
+}
+
+// SetNilRootBehavior sets what Encode does with a nil or empty root, see
+// NilRootBehavior. The null or {} written is the whole output: the root key,
+// the envelope and the other options do not apply to it.
+func (enc *Encoder) SetNilRootBehavior(b NilRootBehavior) *Encoder {
+	enc.nilRoot = b
+	return enc
+}
+
+// SetRootKey makes the output an object with the single key name, whatever
+// the name of the XML root element: {"name": <document>}. When the document
+// already is an object with a single key, such as the root element, that key
+// is renamed rather than wrapped again, unless SetRootKeyWrap is set. Scalar
+// documents are wrapped too. The envelope of SetEnvelope, if any, goes around
+// the result.
+func (enc *Encoder) SetRootKey(name string) *Encoder {
+	enc.rootKey = name
+	return enc
+}
+
+// SetIncludeRoot(false) writes the content of the root element only, without
+// the object holding it under its name: <doc><item>1</item></doc> gives
+// {"item": "1"} rather than {"doc": {"item": "1"}}. The attributes of the root
+// go where SetRootAttributePolicy says, among the top-level keys by default.
+// Documents whose root is not a single element are written whole. The
+// default is true. SetRootKey, if set, wraps the unwrapped document.
+func (enc *Encoder) SetIncludeRoot(b bool) *Encoder {
+	enc.omitRoot = !b
+	return enc
+}
+
+// SetRootAttributePolicy sets where the attributes of the root element go
+// when SetIncludeRoot(false) unwraps it, see RootAttributePolicy
+func (enc *Encoder) SetRootAttributePolicy(p RootAttributePolicy) *Encoder {
+	enc.rootAttrPolicy = p
+	return enc
+}
+
+// SetResultWrapper makes the output an object with the single key key holding
+// the whole document as it would be written otherwise, root element included:
+// {"result": {"root": ...}}, for APIs which return their value under such a
+// key. Unlike SetRootKey, the document is never renamed. Both may be set: the
+// root key is applied first, then the result wrapper goes around the document,
+// and the envelope of SetEnvelope, if any, around the result wrapper:
+// {"$schema": "...", "data": {"result": {"name": ...}}}. An empty key, the
+// default, does not wrap.
+func (enc *Encoder) SetResultWrapper(key string) *Encoder {
+	enc.resultKey = key
+	return enc
+}
+
+// SetRootKeyWrap makes SetRootKey always wrap the document, even when it is
+// an object with a single key: {"name": {"root": ...}}
+func (enc *Encoder) SetRootKeyWrap(b bool) *Encoder {
+	enc.rootKeyWrap = b
+	return enc
+}
+
+// SetForceArray makes the elements with the given labels always encode as
+// JSON arrays, even when they occur only once.
+func (enc *Encoder) SetForceArray(labels ...string) *Encoder {
+	if enc.forceArray == nil {
+		enc.forceArray = map[string]bool{}
+	}
+	for _, label := range labels {
+		enc.forceArray[label] = true
+	}
+	return enc
+}
+
+// SetForceArrayPattern makes the elements whose label matches the regular
+// expression pattern always encode as JSON arrays. The pattern is matched
+// against the whole label, e.g. `.*List` or `item\d+`. An empty pattern clears
+// it. Exact labels from SetForceArray are checked first; the pattern can only
+// add to them and never turns a listed label back into a single value.
+func (enc *Encoder) SetForceArrayPattern(pattern string) error {
+	if pattern == "" {
+		enc.forceArrayRe = nil
+		return nil
+	}
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return err
+	}
+	enc.forceArrayRe = re
+	return nil
+}
+
+// SetDedupeArrayElements drops array elements whose JSON encoding is byte
+// identical to one of their earlier siblings. This changes the number of
+// elements in the output, so only use it when duplicates are known to be noise.
+func (enc *Encoder) SetDedupeArrayElements(b bool) *Encoder {
+	enc.dedupeArrays = b
+	return enc
+}
+
+// SetSanitizeKeys makes every key a valid JavaScript identifier, for
+// consumers such as code generators: characters other than letters, digits,
+// '_' and '$' (e.g. '-', '.', ':' or the attribute prefix) are replaced by '_',
+// and keys starting with a digit are prefixed with '_'. This is lossy: "a-b"
+// and "a.b" both become "a_b", and there is no way to tell them apart again.
+// JSON-LD keys such as "@id" do not survive either.
+func (enc *Encoder) SetSanitizeKeys(b bool) *Encoder {
+	enc.sanitizeKeys = b
+	return enc
+}
+
+// SetPreserveOrder makes the keys of each object follow the order in which the
+// children were added (document order when decoded) instead of being sorted.
+// Repeated elements are grouped at the position of their first occurrence.
+// It is a shorthand for SetSortOrder(None), or SetSortOrder(Ascending) when
+// b is false.
+func (enc *Encoder) SetPreserveOrder(b bool) *Encoder {
+	if b {
+		return enc.SetSortOrder(None)
+	}
+	return enc.SetSortOrder(Ascending)
+}
+
+// SetSortOrder sets the order in which the keys of each object are written
+func (enc *Encoder) SetSortOrder(order SortOrder) *Encoder {
+	enc.sortOrder = order
+	return enc
+}
+
+// SetKeyClashPolicy sets what to do when an attribute and an element of the
+// same node share a label, see KeyClashPolicy. Only nodes with IsAttribute set,
+// as done by the Decoder, are considered attributes.
+func (enc *Encoder) SetKeyClashPolicy(policy KeyClashPolicy) *Encoder {
+	enc.keyClash = policy
+	return enc
+}
+
+// SetAttributedScalarLayout sets how elements with attributes and text but no
+// child element are written, see AttributedScalarLayout.
+func (enc *Encoder) SetAttributedScalarLayout(layout AttributedScalarLayout) *Encoder {
+	enc.attributedScalar = layout
+	return enc
+}
+
+// SetAttributeKeyFunc sets the function giving the key of each attribute from
+// its name, for conventions other than a prefix, e.g. a suffix as in
+// "id@attr". The name is the label of the attribute without the attribute
+// prefix. fn takes precedence over the other options about attribute keys. Only
+// nodes with IsAttribute set, as done by the Decoder, are attributes.
+func (enc *Encoder) SetAttributeKeyFunc(fn func(name string) string) *Encoder {
+	enc.attrKeyFunc = fn
+	return enc
+}
+
+// SetKeyRename sets new keys for the elements named in names, e.g.
+// {"Body": "body"}, elements being named without their namespace prefix. Only
+// elements are renamed: attributes have SetAttributeKeyFunc. The other
+// options about an element still apply under its name in the document, and
+// the new key still goes through SetSanitizeKeys. Sorted output is sorted on
+// the new keys. When an element is renamed to the key of a sibling, both are
+// written as a single array, the options of the first one in output order
+// applying, unless the key clash policy is ClashError, in which case Encode
+// returns an error wrapping ErrKeyClash.
+func (enc *Encoder) SetKeyRename(names map[string]string) *Encoder {
+	enc.keyRename = names
+	return enc
+}
+
+// SetSmartAttributePrefix writes attributes without their prefix, unless a
+// sibling element has the same name: <a id="1"><name>x</name></a> gives
+// {"id": "1", "name": "x"}, while <a id="1"><id>2</id></a> keeps "-id". The
+// result only depends on the names of the siblings, never on their order, and
+// elements never get a prefix. The encoder's attribute prefix must be the one
+// used to decode, and only nodes with IsAttribute set are considered.
+func (enc *Encoder) SetSmartAttributePrefix(b bool) *Encoder {
+	enc.smartPrefix = b
+	return enc
+}
+
+// SetSchema forces arrays, as SetForceArray does, for the elements which can
+// repeat according to the XSD read from r: those with maxOccurs above 1 or
+// "unbounded", or within a sequence or choice which can repeat. Only element
+// declarations are read, by local name, regardless of where they are declared:
+// the schema is neither validated nor fully resolved (no imports, named types
+// or group references), so elements it declares in several places with
+// different maxOccurs are always arrays.
+func (enc *Encoder) SetSchema(r io.Reader) error {
+	names, err := repeatableElements(r)
+	if err != nil {
+		return err
+	}
+	enc.SetForceArray(names...)
+	return nil
+}
+
+// isForcedArray returns whether label must be encoded as an array
+func (enc *Encoder) isForcedArray(label string) bool {
+	if enc.forceArray[label] {
+		return true
+	}
+	return enc.forceArrayRe != nil && enc.forceArrayRe.MatchString(label)
+}
+
+// SetMaxEncodeDepth makes Encode fail with ErrMaxEncodeDepth, instead of
+// recursing without bound, on trees nested deeper than n nodes, the node given
+// to Encode being at depth 1. 0, the default, means no limit. Use it when
+// encoding trees built from untrusted input.
+func (enc *Encoder) SetMaxEncodeDepth(n int) *Encoder {
+	enc.maxDepth = n
+	return enc
+}
+
+// SetLinePrefix sets a prefix written at the start of every line after the
+// first, before the indentation. It only has an effect with SetIndent, and is
+// useful to embed the output in an already indented document.
+func (enc *Encoder) SetLinePrefix(s string) *Encoder {
+	enc.linePrefix = s
+	return enc
+}
+
+func (enc *Encoder) EncodeWithCustomPrefixes(root *Node, contentPrefix string, attributePrefix string) error {
+	enc.contentPrefix = contentPrefix
+	enc.attributePrefix = attributePrefix
+	return enc.Encode(root)
+}
+
+// Encode writes the JSON encoding of v to the stream
+func (enc *Encoder) Encode(root *Node) error {
+	if enc.err != nil {
+		return enc.err
+	}
+	if root == nil || (!root.Null && root.Data == "" && !root.HasChildren()) {
+		switch enc.nilRoot {
+		case NilRootWriteNull:
+			enc.write("null\n")
+			return enc.err
+		case NilRootWriteEmptyObject:
+			enc.write("{}\n")
+			return enc.err
+		case NilRootReturnError:
+			return ErrEmptyRoot
+		}
+		if root == nil {
+			return nil
+		}
+	}
+	if enc.omitRoot {
+		root = enc.unwrapRoot(root)
+	}
+	if enc.rootKey != "" {
+		root = enc.wrapRoot(root)
+	} else if enc.wrapScalarRoot && !root.HasChildren() && (root.Null || !enc.separateText) {
+		wrapped := &Node{}
+		wrapped.AddChild(enc.contentKey(root), root)
+		root = wrapped
+	}
+	if enc.resultKey != "" {
+		wrapped := &Node{}
+		wrapped.AddChild(enc.resultKey, root)
+		root = wrapped
+	}
+
+	if enc.envelope != nil {
+		enc.err = enc.formatEnvelope(root)
+	} else {
+		enc.err = enc.format(root, 0)
+	}
+
+	// Terminate each value with a newline.  This makes the output look a little nicer
+	// when debugging, and some kind of space is required if the encoded value was a number,
+	// so that the reader knows there aren't more digits coming.
+	enc.write("\n")
+	if enc.flushEvery > 0 || enc.arrayFlushEvery > 0 || enc.arrayStreamThresh > 0 {
+		enc.autoFlush()
+	}
+
+	return enc.err
+}
+
+// EncodeWithHash is like Encode but also writes the output to h, so that the
+// digest of the JSON document can be read from h afterwards. Stable digests
+// need a deterministic output: keep the keys sorted (the default) rather than
+// using SetSortOrder(None), as insertion order depends on how the tree was
+// built.
+func (enc *Encoder) EncodeWithHash(root *Node, h hash.Hash) error {
+	w := enc.w
+	enc.w = io.MultiWriter(w, h)
+	defer func() { enc.w = w }()
+
+	return enc.Encode(root)
+}
+
+// EncodePath writes the JSON encoding of the subtree found at path (see
+// Node.Get) to the stream. When path selects several nodes, they are encoded
+// as an array. When it selects none, an error wrapping ErrNotFound is returned.
+func (enc *Encoder) EncodePath(root *Node, path string) error {
+	if enc.err != nil {
+		return enc.err
+	}
+
+	nodes := root.Get(path)
+	switch len(nodes) {
+	case 0:
+		return fmt.Errorf("path %q: %w", path, ErrNotFound)
+	case 1:
+		return enc.Encode(nodes[0])
+	}
+
+	enc.write("[")
+	for ii, n := range nodes {
+		if ii > 0 {
+			enc.write(enc.itemSep())
+		}
+		enc.err = enc.format(n, 1)
+		if enc.err != nil {
+			return enc.err
+		}
+	}
+	enc.write("]\n")
+
+	return enc.err
+}
+
+// EncodeNDJSON writes the nodes selected by recordLabel (a label or a path,
+// see Node.Get) as newline delimited JSON: one compact JSON document per line,
+// whatever the indentation settings. Only the records are written, not the
+// elements wrapping them. When there are no records, an error wrapping
+// ErrNotFound is returned.
+func (enc *Encoder) EncodeNDJSON(root *Node, recordLabel string) error {
+	if enc.err != nil {
+		return enc.err
+	}
+
+	records := root.Get(recordLabel)
+	if len(records) == 0 {
+		return fmt.Errorf("records %q: %w", recordLabel, ErrNotFound)
+	}
+
+	indent := enc.indent
+	enc.indent = false
+	defer func() { enc.indent = indent }()
+
+	for _, n := range records {
+		enc.err = enc.format(n, 0)
+		if enc.err != nil {
+			return enc.err
+		}
+		enc.write("\n")
+	}
+
+	return enc.err
+}
+
+// wrapRoot returns a node holding the document of root under the root key
+func (enc *Encoder) wrapRoot(root *Node) *Node {
+	doc := root
+	if !enc.rootKeyWrap && !root.Null && root.Data == "" && len(root.Children) == 1 {
+		for _, children := range root.Children {
+			if len(children) == 1 {
+				doc = children[0]
+			}
+		}
+	}
+
+	wrapped := &Node{}
+	wrapped.AddChild(enc.rootKey, doc)
+	return wrapped
+}
+
+// unwrapRoot returns the root element of the document root for
+// SetIncludeRoot(false), its attributes placed as per SetRootAttributePolicy,
+// or root itself if it does not hold a single element
+func (enc *Encoder) unwrapRoot(root *Node) *Node {
+	if root.Null || root.Data != "" || len(root.Children) != 1 {
+		return root
+	}
+	var elem *Node
+	for _, children := range root.Children {
+		if len(children) != 1 || children[0].IsAttribute {
+			return root
+		}
+		elem = children[0]
+	}
+	if enc.rootAttrPolicy == RootAttributesPromote {
+		return elem
+	}
+
+	doc := NewNode(elem.Data)
+	doc.Null, doc.Raw, doc.Preserved = elem.Null, elem.Raw, elem.Preserved
+	children := elem.orderedChildren()
+	if enc.rootAttrPolicy == RootAttributesNest {
+		attrs := NewNode("")
+		for _, c := range children {
+			if c.n.IsAttribute {
+				attrs.AddChild(c.label, c.n)
+			}
+		}
+		if attrs.HasChildren() {
+			doc.AddChild(rootAttributesKey, attrs)
+		}
+	}
+	for _, c := range children {
+		if !c.n.IsAttribute {
+			doc.AddChild(c.label, c.n)
+		}
+	}
+	return doc
+}
+
+// formatEnvelope writes root wrapped in the envelope
+func (enc *Encoder) formatEnvelope(root *Node) error {
+	keys := make([]string, 0, len(enc.envelope))
+	for k := range enc.envelope {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sep := enc.comma()
+	enc.write("{")
+	if enc.indent {
+		enc.write("\n")
+	}
+	for _, k := range keys {
+		b, err := json.Marshal(enc.envelope[k])
+		if err != nil {
+			return err
+		}
+		if enc.asciiOnly {
+			b = escapeNonASCII(b)
+		}
+		enc.indentN(1)
+		enc.member(k)
+		enc.write(string(b))
+		enc.endMember()
+		enc.write(sep)
+	}
+
+	enc.indentN(1)
+	enc.member(enc.envelopeKey)
+	if err := enc.format(root, 1); err != nil {
+		return err
+	}
+	enc.endMember()
+	enc.endLast()
+	enc.write("}")
+	return nil
+}
+
+// xyzzy004 - comment
+func (enc *Encoder) format(curNode *Node, lvl int) error {
+	if enc.maxDepth > 0 {
+		if enc.depth++; enc.depth > enc.maxDepth {
+			enc.depth--
+			return ErrMaxEncodeDepth
+		}
+		defer func() { enc.depth-- }()
+	}
+	indentN := enc.indentN
+	if curNode.Null {
+		enc.write("null")
+	} else if enc.hasChildren(curNode) {
+		entries, err := enc.entries(curNode)
+		if err != nil {
+			return err
+		}
+		if enc.wrapperStyle == ArrayWrapped && hasRepeated(entries) {
+			return enc.formatWrapped(curNode, entries, lvl)
+		}
+		if enc.groupConsecutive {
+			if runs := enc.runs(curNode); runs != nil {
+				return enc.formatRuns(curNode, runs, lvl)
+			}
+		}
+
+		enc.write("{")
+		if enc.indent {
+			enc.write("\n")
+		}
+		if enc.pathKey != "" && len(enc.emitPath) > 0 {
+			indentN(lvl + 1)
+			path := strings.Join(enc.emitPath, ".")
+			enc.member(enc.pathKey)
+			enc.writeQuoted(path)
+			enc.endMember()
+			enc.write(enc.comma())
+		}
+
+		// xyzzy005 - must sort names before print?  Attributes must be in order for compare.
+
+		compact := enc.attributedScalar != AttributedScalarNested && enc.isAttributedScalar(curNode)
+
+		// Add data as an additional attibute (if any)
+		if len(curNode.Data) > 0 && !(enc.omitEmptyContent && enc.isLayout(curNode)) {
+			key := enc.contentKey(curNode)
+			if compact && enc.mixedContentKey == "" {
+				key = "_"
+			}
+			indentN(lvl + 1)
+			enc.member(key)
+			enc.writeScalar(curNode.Data, enc.infers(curNode))
+			enc.endMember()
+			enc.write(enc.comma())
+		}
+
+		com := ""
+		for _, e := range entries {
+			enc.write(com)
+			com = enc.comma()
+			indentN(lvl + 1)
+			key := enc.entryKey(e, compact)
+			if enc.isPromoted(e) {
+				if err := enc.formatPromoted(key, e, lvl); err != nil {
+					return err
+				}
+				continue
+			}
+			enc.member(key)
+			if err := enc.formatChildren(e, lvl); err != nil {
+				return err
+			}
+			enc.endMember()
+		}
+
+		enc.endLast()
+		indentN(lvl)
+		enc.write("}")
+	} else if curNode.HasChildren() && curNode.Data == "" {
+		// Only with SetOmitEmpty, for a document with nothing left
+		enc.write("{}")
+	} else if enc.separateText && !curNode.IsAttribute {
+		if len(curNode.Data) == 0 {
+			enc.write("{}")
+			return nil
+		}
+		enc.formatTextObject(curNode, enc.contentKey(curNode), lvl)
+	} else {
+		enc.writeScalar(curNode.Data, enc.infers(curNode))
+	}
+
+	return nil
+}
+
+// isLayout returns whether the text of n is only whitespace laying out its
+// children, for SetOmitEmptyContent
+func (enc *Encoder) isLayout(n *Node) bool {
+	if strings.TrimSpace(n.Data) != "" {
+		return false
+	}
+	if !n.Preserved {
+		return true
+	}
+	for _, children := range n.Children {
+		if !isAttributeEntry(entry{children: children}) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatTextObject writes the text of n as an object with the single key key
+func (enc *Encoder) formatTextObject(n *Node, key string, lvl int) {
+	enc.write("{")
+	if enc.indent {
+		enc.write("\n")
+	}
+	enc.indentN(lvl + 1)
+	enc.member(key)
+	enc.writeScalar(n.Data, enc.infers(n))
+	enc.endMember()
+	enc.endLast()
+	enc.indentN(lvl)
+	enc.write("}")
+}
+
+// hasMixedContent returns whether one of nodes has both text and children
+func hasMixedContent(nodes Nodes) bool {
+	for _, n := range nodes {
+		if !n.Null && n.Data != "" && n.HasChildren() {
+			return true
+		}
+	}
+	return false
+}
+
+// labels returns the labels of the children of curNode in output order
+func (enc *Encoder) labels(curNode *Node) []string {
+	if enc.sortOrder == None {
+		return curNode.orderedLabels()
+	}
+
+	sl := make([]string, 0, len(curNode.Children))
+	for label := range curNode.Children {
+		sl = append(sl, label)
+	}
+	if len(sl) > 1 {
+		if enc.sortOrder == Descending {
+			sort.Sort(sort.Reverse(sort.StringSlice(sl)))
+		} else {
+			sort.Strings(sl)
+		}
+	}
+	return sl
+}
+
+// formatChildren writes the value of the key of e in an object at level lvl,
+// holding the children of e: an array, or a single value
+func (enc *Encoder) formatChildren(e entry, lvl int) error {
+	label, children := e.label, e.children
+	if enc.groupByLang && len(children) > 1 {
+		if langs := enc.langs(children); langs != nil {
+			return enc.formatLangs(langs, children, lvl)
+		}
+	}
+
+	forced := e.array || enc.isForcedArray(label)
+	if len(children) == 1 && !forced {
+		return enc.formatElement(label, children[0], lvl+1)
+	}
+
+	if enc.sortScalarArrays {
+		children = enc.sortScalars(label, children)
+	}
+	if enc.dedupeArrays {
+		var err error
+		if children, err = enc.dedupe(children, lvl+2); err != nil {
+			return err
+		}
+	}
+	total := len(children)
+	truncated := enc.arrayLimit > 0 && total > enc.arrayLimit
+	if truncated {
+		children = children[:enc.arrayLimit]
+	}
+
+	if len(children) == 1 && !forced && enc.collapseSingletons {
+		if err := enc.formatElement(label, children[0], lvl+1); err != nil {
+			return err
+		}
+	} else if enc.arrayKey != nil {
+		enc.write("{")
+		if enc.indent {
+			enc.write("\n")
+		}
+		for ii, ch := range children {
+			if ii > 0 {
+				enc.write(enc.comma())
+			}
+			enc.indentN(lvl + 2)
+			enc.member(enc.arrayKey(ii, ch))
+			if err := enc.formatElement(label, ch, lvl+2); err != nil {
+				return err
+			}
+			enc.endMember()
+		}
+		enc.endLast()
+		enc.indentN(lvl + 1)
+		enc.write("}")
+	} else {
+		enc.write("[") // xyzzy006 - need to estimate if length is less than X- then one line - else - multi-line
+		wrap := enc.indent && enc.itemsPerLine > 0
+		if wrap {
+			enc.write("\n")
+		}
+		asStrings := enc.homogeneous && !enc.isHomogeneous(children)
+		textObjects := enc.mixedArrayShape == MixedArrayObjects && hasMixedContent(children)
+		onLine := 0
+		key := ""
+		if n := len(enc.emitPath); n > 0 {
+			key = enc.emitPath[n-1]
+		}
+		for ii, ch := range children {
+			enc.index(key, ii)
+			if wrap {
+				if ii > 0 && onLine > 0 && onLine < enc.itemsPerLine && enc.isScalar(ch) {
+					enc.write(enc.itemSep())
+				} else {
+					if ii > 0 {
+						enc.write(",\n")
+					}
+					enc.indentN(lvl + 2)
+					onLine = 0
+				}
+				if onLine++; !enc.isScalar(ch) {
+					onLine = enc.itemsPerLine
+				}
+			} else if ii > 0 {
+				enc.write(enc.itemSep())
+			}
+			if textObjects && !ch.Null && !enc.hasChildren(ch) && enc.elementEncoders[label] == nil {
+				key := enc.mixedContentKey
+				if key == "" {
+					key = enc.contentKey(ch)
+				}
+				enc.formatTextObject(ch, key, lvl+2)
+			} else if asStrings && !ch.Null && !ch.HasChildren() && enc.elementEncoders[label] == nil {
+				enc.writeQuoted(ch.Data)
+			} else if err := enc.formatElement(label, ch, lvl+2); err != nil {
+				return err
+			}
+			if enc.arrayFlushEvery > 0 && (ii+1)%enc.arrayFlushEvery == 0 {
+				enc.autoFlush()
+			} else if t := enc.arrayStreamThresh; t > 0 && len(children) > t && ii+1 >= t {
+				enc.autoFlush()
+			}
+		}
+		if wrap {
+			enc.endLast()
+			enc.indentN(lvl + 1)
+		}
+		enc.index(key, -1)
+		enc.write("]")
+	}
+
+	if truncated && enc.truncationSuffix != "" {
+		enc.write(enc.comma())
+		enc.indentN(lvl + 1)
+		enc.member(label + enc.truncationSuffix)
+		enc.write(strconv.Itoa(total))
+		enc.endMember()
+	}
+	return nil
+}
+
+// hasRepeated returns whether an entry has several children
+func hasRepeated(entries []entry) bool {
+	for _, e := range entries {
+		if len(e.children) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// formatWrapped writes curNode as an array of single-key objects, for
+// ArrayWrapped
+func (enc *Encoder) formatWrapped(curNode *Node, entries []entry, lvl int) error {
+	enc.write("[")
+	sep := ""
+	if curNode.Data != "" {
+		enc.openWrapper(enc.contentKey(curNode), lvl+1)
+		enc.writeScalar(curNode.Data, enc.infers(curNode))
+		enc.closeWrapper(lvl + 1)
+		sep = enc.itemSep()
+	}
+	for _, e := range entries {
+		for _, ch := range e.children {
+			enc.write(sep)
+			enc.openWrapper(enc.entryKey(e, false), lvl+1)
+			if err := enc.formatElement(e.label, ch, lvl+2); err != nil {
+				return err
+			}
+			enc.closeWrapper(lvl + 1)
+			sep = enc.itemSep()
+		}
+	}
+	enc.write("]")
+	return nil
+}
+
+// openWrapper starts a single-key object of the arrays of formatWrapped and
+// formatRuns, at lvl, up to its key
+func (enc *Encoder) openWrapper(key string, lvl int) {
+	enc.write("{")
+	if enc.indent {
+		enc.write("\n")
+	}
+	enc.indentN(lvl + 1)
+	enc.member(key)
+}
+
+// closeWrapper ends the object started by openWrapper, once its value is
+// written
+func (enc *Encoder) closeWrapper(lvl int) {
+	enc.endMember()
+	enc.endLast()
+	enc.indentN(lvl)
+	enc.write("}")
+}
+
+// runs returns the children of n grouped in runs of consecutive children with
+// the same label, in document order, or nil if no label has several runs
+func (enc *Encoder) runs(n *Node) []entry {
+	var runs []entry
+	seen := map[string]bool{}
+	interleaved := false
+	for _, c := range n.orderedChildren() {
+		if enc.omitEmpty && isEmpty(c.n) {
+			continue
+		}
+		if last := len(runs) - 1; last >= 0 && runs[last].label == c.label {
+			runs[last].children = append(runs[last].children, c.n)
+			continue
+		}
+		interleaved = interleaved || seen[c.label]
+		seen[c.label] = true
+		runs = append(runs, entry{label: c.label, children: Nodes{c.n}})
+	}
+	if !interleaved {
+		return nil
+	}
+	return runs
+}
+
+// formatRuns writes curNode as an array of single-key objects, one per run,
+// for SetGroupConsecutiveOnly
+func (enc *Encoder) formatRuns(curNode *Node, runs []entry, lvl int) error {
+	enc.write("[")
+	sep := ""
+	if curNode.Data != "" {
+		enc.openWrapper(enc.contentKey(curNode), lvl+1)
+		enc.writeScalar(curNode.Data, enc.infers(curNode))
+		enc.closeWrapper(lvl + 1)
+		sep = enc.itemSep()
+	}
+	for _, r := range runs {
+		enc.write(sep)
+		enc.openWrapper(enc.entryKey(r, false), lvl+1)
+		if err := enc.formatChildren(r, lvl+1); err != nil {
+			return err
+		}
+		enc.closeWrapper(lvl + 1)
+		sep = enc.itemSep()
+	}
+	enc.write("]")
+	return nil
+}
+
+// isScalar returns whether n is written as a JSON scalar, for
+// SetArrayItemsPerLine
+func (enc *Encoder) isScalar(n *Node) bool {
+	if n.Null {
+		return true
+	}
+	return !enc.hasChildren(n) && !(enc.separateText && !n.IsAttribute)
+}
+
+// sortScalars returns a copy of the children of label sorted for
+// SetSortScalarArrays, or children as is if they are not all scalars
+func (enc *Encoder) sortScalars(label string, children Nodes) Nodes {
+	if enc.elementEncoders[label] != nil {
+		return children
+	}
+	numeric := true
+	for _, ch := range children {
+		if !enc.isScalar(ch) {
+			return children
+		}
+		if !ch.Null && !(enc.infers(ch) && isNumber(ch.Data)) {
+			numeric = false
+		}
+	}
+
+	sorted := append(Nodes{}, children...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Null || b.Null {
+			return a.Null && !b.Null
+		}
+		if numeric {
+			x, _ := strconv.ParseFloat(a.Data, 64)
+			y, _ := strconv.ParseFloat(b.Data, 64)
+			return x < y
+		}
+		return a.Data < b.Data
+	})
+	return sorted
+}
+
+// hasChildren returns whether n is written as an object of its children
+func (enc *Encoder) hasChildren(n *Node) bool {
+	if !enc.omitEmpty {
+		return n.HasChildren()
+	}
+	for _, children := range n.Children {
+		if len(nonEmpty(children)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmpty returns whether n is left out with SetOmitEmpty: it is not null,
+// not an attribute, has no text and only empty children
+func isEmpty(n *Node) bool {
+	if n.Null || n.IsAttribute || n.Data != "" {
+		return false
+	}
+	for _, children := range n.Children {
+		for _, ch := range children {
+			if !isEmpty(ch) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nonEmpty returns the nodes of children which are not empty, children itself
+// if none is
+func nonEmpty(children Nodes) Nodes {
+	for i, ch := range children {
+		if isEmpty(ch) {
+			res := append(Nodes{}, children[:i]...)
+			for _, ch := range children[i+1:] {
+				if !isEmpty(ch) {
+					res = append(res, ch)
+				}
+			}
+			return res
+		}
+	}
+	return children
+}
+
+// isAttributedScalar returns whether n has text and attributes only
+func (enc *Encoder) isAttributedScalar(n *Node) bool {
+	if n.Null || n.Data == "" || !n.HasChildren() {
+		return false
+	}
+	for _, children := range n.Children {
+		for _, ch := range children {
+			if !ch.IsAttribute {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isPromoted returns whether the element of e is written with
+// AttributedScalarPromoted
+func (enc *Encoder) isPromoted(e entry) bool {
+	return enc.attributedScalar == AttributedScalarPromoted && len(e.children) == 1 &&
+		!e.array && !enc.isForcedArray(e.label) && enc.elementEncoders[e.label] == nil &&
+		enc.isAttributedScalar(e.children[0])
+}
+
+// formatPromoted writes the text of the element of e under key, then its
+// attributes as sibling keys
+func (enc *Encoder) formatPromoted(key string, e entry, lvl int) error {
+	n := e.children[0]
+	enc.member(key)
+	enc.writeScalar(n.Data, enc.infers(n))
+	enc.endMember()
+	attrs, err := enc.entries(n)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		enc.write(enc.comma())
+		enc.indentN(lvl + 1)
+		enc.member(key + promotedAttrSep + strings.TrimPrefix(a.label, enc.attributePrefix))
+		if err := enc.formatChildren(a, lvl); err != nil {
+			return err
+		}
+		enc.endMember()
+	}
+	return nil
+}
+
+// formatElement writes n, the element label, with its element encoder if it
+// has one
+func (enc *Encoder) formatElement(label string, n *Node, lvl int) error {
+	if n.IsAttribute && enc.tokenAttrs[strings.TrimPrefix(label, enc.attributePrefix)] {
+		enc.formatTokens(n)
+		return nil
+	}
+	if n.IsAttribute && enc.emptyAttrAsTrue && !n.Null &&
+		(n.Data == "" || strings.EqualFold(n.Data, strings.TrimPrefix(label, enc.attributePrefix))) {
+		enc.write("true")
+		return nil
+	}
+	if from, ok := enc.binaryElements[label]; ok && !n.Null && !n.HasChildren() {
+		s, err := convertBinary(n.Data, from)
+		if err != nil {
+			return fmt.Errorf("element %q: %w", label, err)
+		}
+		enc.writeQuoted(s)
+		return nil
+	}
+	fn := enc.elementEncoders[label]
+	if fn == nil {
+		if spec, ok := enc.joins[label]; ok && !n.Null {
+			if s, ok := enc.joinChildren(label, n, spec); ok {
+				enc.writeQuoted(s)
+				return nil
+			}
+		}
+		return enc.format(n, lvl)
+	}
+	raw, err := fn(n)
+	if err != nil {
+		return fmt.Errorf("element %q: %w", label, err)
+	}
+	if !json.Valid(raw) {
+		return fmt.Errorf("element %q: invalid JSON from element encoder: %q", label, raw)
+	}
+	enc.write(string(raw))
+	return nil
+}
+
+// joinChildren returns the texts of the children of n, the element label,
+// joined as per spec, or false with a warning if they cannot be
+func (enc *Encoder) joinChildren(label string, n *Node, spec joinSpec) (string, bool) {
+	children := n.Children[spec.child]
+	if n.Data != "" || len(n.Children) != 1 || len(children) == 0 {
+		enc.warnings = append(enc.warnings, fmt.Sprintf("element %q: not only %q children, not joined", label, spec.child))
+		return "", false
+	}
+	texts := make([]string, len(children))
+	for i, c := range children {
+		if c.Null || c.HasChildren() || c.IsAttribute {
+			enc.warnings = append(enc.warnings, fmt.Sprintf("element %q: %q child is not a scalar, not joined", label, spec.child))
+			return "", false
+		}
+		texts[i] = c.Data
+	}
+	return strings.Join(texts, spec.sep), true
+}
+
+// formatTokens writes the space-separated value of the attribute n as an
+// array, each token being inferred as the attribute value would be
+func (enc *Encoder) formatTokens(n *Node) {
+	tokens := strings.Fields(n.Data)
+	infer := enc.infers(n)
+	if len(tokens) == 1 && enc.singleTokenScalar {
+		enc.writeScalar(tokens[0], infer)
+		return
+	}
+	enc.write("[")
+	for i, tok := range tokens {
+		if i > 0 {
+			enc.write(enc.itemSep())
+		}
+		enc.writeScalar(tok, infer)
+	}
+	enc.write("]")
+}
+
+// convertBinary turns data from the from binary encoding into the other one
+func convertBinary(data string, from BinaryEncoding) (string, error) {
+	data = strings.Join(strings.Fields(data), "")
+	if from == HexBinary {
+		b, err := hexenc.DecodeString(data)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	return hexenc.EncodeToString(b), nil
+}
+
+// langs returns the xml:lang of each of children, or nil if they cannot be
+// grouped by language
+func (enc *Encoder) langs(children Nodes) []string {
+	label := enc.attributePrefix + "lang"
+	langs := make([]string, 0, len(children))
+	seen := map[string]bool{}
+	for _, ch := range children {
+		attrs := ch.Children[label]
+		if len(attrs) != 1 || !attrs[0].IsAttribute || seen[attrs[0].Data] {
+			return nil
+		}
+		seen[attrs[0].Data] = true
+		langs = append(langs, attrs[0].Data)
+	}
+	return langs
+}
+
+// formatLangs writes children as an object keyed by their langs, without
+// their xml:lang attribute
+func (enc *Encoder) formatLangs(langs []string, children Nodes, lvl int) error {
+	enc.write("{")
+	if enc.indent {
+		enc.write("\n")
+	}
+	for ii, ch := range children {
+		if ii > 0 {
+			enc.write(enc.comma())
+		}
+		enc.indentN(lvl + 2)
+		c := *ch
+		c.Children = make(map[string]Nodes, len(ch.Children)-1)
+		for label, nodes := range ch.Children {
+			if label != enc.attributePrefix+"lang" {
+				c.Children[label] = nodes
+			}
+		}
+		enc.member(langs[ii])
+		if err := enc.format(&c, lvl+2); err != nil {
+			return err
+		}
+		enc.endMember()
+	}
+	enc.endLast()
+	enc.indentN(lvl + 1)
+	enc.write("}")
+	return nil
 }
 
-// NewEncoder returns a new encoder that writes to w.
-func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{
-		w:               w,
-		contentPrefix:   contentPrefix,
-		attributePrefix: attrPrefix,
-		indent:          false,
-		indentText:      "",
+// dedupe returns children without the nodes whose JSON encoding is the same
+// as the one of an earlier node
+func (enc *Encoder) dedupe(children Nodes, lvl int) (Nodes, error) {
+	res := make(Nodes, 0, len(children))
+	seen := map[[sha256.Size]byte]bool{}
+	for _, ch := range children {
+		b, err := enc.render(ch, lvl)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		if !seen[sum] {
+			seen[sum] = true
+			res = append(res, ch)
+		}
 	}
+	return res, nil
 }
 
-func (enc *Encoder) SetAttributePrefix(prefix string) *Encoder {
-	enc.attributePrefix = prefix
-	return enc
+// entry is a key of an object with the nodes to encode as its value
+type entry struct {
+	label    string
+	children Nodes
+	array    bool // written as an array even with a single child
 }
 
-func (enc *Encoder) SetContentPrefix(prefix string) *Encoder {
-	enc.contentPrefix = prefix
-	return enc
+// entries returns the keys of the object encoding curNode, in output order
+func (enc *Encoder) entries(curNode *Node) ([]entry, error) {
+	sl := enc.labels(curNode)
+	entries := make([]entry, 0, len(sl))
+	for _, label := range sl {
+		children := curNode.Children[label]
+		if enc.omitEmpty {
+			if children = nonEmpty(children); len(children) == 0 {
+				continue
+			}
+		}
+		if enc.keyClash == ClashMergeIntoArray {
+			entries = append(entries, entry{label: label, children: children})
+			continue
+		}
+
+		var attrs, elems Nodes
+		for _, ch := range children {
+			if ch.IsAttribute {
+				attrs = append(attrs, ch)
+			} else {
+				elems = append(elems, ch)
+			}
+		}
+		if len(attrs) == 0 || len(elems) == 0 {
+			entries = append(entries, entry{label: label, children: children})
+			continue
+		}
+		if enc.keyClash == ClashError {
+			return nil, fmt.Errorf("%w: %q is both an attribute and an element", ErrKeyClash, label)
+		}
+		entries = append(entries,
+			entry{label: label, children: elems},
+			entry{label: label + attrClashSuffix, children: attrs})
+	}
+
+	for _, prefix := range enc.attrGroups {
+		entries = enc.groupAttributes(entries, prefix)
+	}
+	if enc.smartPrefix {
+		enc.stripAttributePrefixes(entries)
+	}
+	if len(enc.keyRename) > 0 {
+		return enc.mergeRenamed(entries)
+	}
+	return entries, nil
 }
 
-func (enc *Encoder) SetIndent(s string) *Encoder {
-	enc.indent = true
-	enc.indentText = s
-	return enc
+// groupAttributes replaces the attribute entries named prefix followed by an
+// index with a single entry, for SetAttributeGroup
+func (enc *Encoder) groupAttributes(entries []entry, prefix string) []entry {
+	label := enc.attributePrefix + prefix
+	type indexed struct {
+		i int
+		n *Node
+	}
+	var group []indexed
+	res := make([]entry, 0, len(entries))
+	at := -1
+	for _, e := range entries {
+		if e.label == label && isAttributeEntry(e) {
+			// Already taken by an attribute without index
+			return entries
+		}
+		if i, ok := groupIndex(e, label); ok {
+			for _, n := range e.children {
+				group = append(group, indexed{i, n})
+			}
+			if at < 0 {
+				at = len(res)
+				res = append(res, entry{label: label, array: true})
+			}
+			continue
+		}
+		res = append(res, e)
+	}
+	if at < 0 {
+		return entries
+	}
+
+	sort.SliceStable(group, func(a, b int) bool { return group[a].i < group[b].i })
+	for _, g := range group {
+		res[at].children = append(res[at].children, g.n)
+	}
+	return res
 }
 
-func (enc *Encoder) EncodeWithCustomPrefixes(root *Node, contentPrefix string, attributePrefix string) error {
-	enc.contentPrefix = contentPrefix
-	enc.attributePrefix = attributePrefix
-	return enc.Encode(root)
+// groupIndex returns the index of the attribute entry e of the group label,
+// the digits label is followed by
+func groupIndex(e entry, label string) (int, bool) {
+	if !strings.HasPrefix(e.label, label) || !isAttributeEntry(e) {
+		return 0, false
+	}
+	suffix := e.label[len(label):]
+	if suffix == "" || strings.Trim(suffix, "0123456789") != "" {
+		return 0, false
+	}
+	i, err := strconv.Atoi(suffix)
+	return i, err == nil
 }
 
-// Encode writes the JSON encoding of v to the stream
-func (enc *Encoder) Encode(root *Node) error {
-	if enc.err != nil {
-		return enc.err
+// mergeRenamed merges the element entries which have the same key once
+// renamed by SetKeyRename
+func (enc *Encoder) mergeRenamed(entries []entry) ([]entry, error) {
+	res := make([]entry, 0, len(entries))
+	at := map[string]int{}
+	for _, e := range entries {
+		if isAttributeEntry(e) {
+			res = append(res, e)
+			continue
+		}
+		key := enc.entryKey(e, false)
+		i, ok := at[key]
+		if !ok {
+			at[key] = len(res)
+			res = append(res, e)
+			continue
+		}
+		if enc.keyClash == ClashError {
+			return nil, fmt.Errorf("%w: %q and %q both have the key %q", ErrKeyClash, res[i].label, e.label, key)
+		}
+		res[i].children = append(append(Nodes{}, res[i].children...), e.children...)
 	}
-	if root == nil {
-		return nil
+
+	// Keep sorted output sorted on the keys actually written
+	if enc.sortOrder != None {
+		sort.SliceStable(res, func(i, j int) bool {
+			if enc.sortOrder == Descending {
+				return enc.entryKey(res[i], false) > enc.entryKey(res[j], false)
+			}
+			return enc.entryKey(res[i], false) < enc.entryKey(res[j], false)
+		})
 	}
+	return res, nil
+}
 
-	enc.err = enc.format(root, 0)
+// stripAttributePrefixes removes the attribute prefix from the attribute
+// entries which would not clash with an element entry without it
+func (enc *Encoder) stripAttributePrefixes(entries []entry) {
+	if enc.attributePrefix == "" {
+		return
+	}
 
-	// Terminate each value with a newline.  This makes the output look a little nicer
-	// when debugging, and some kind of space is required if the encoded value was a number,
-	// so that the reader knows there aren't more digits coming.
-	enc.write("\n")
+	taken := map[string]bool{}
+	for _, e := range entries {
+		if !isAttributeEntry(e) {
+			taken[e.label] = true
+		}
+	}
 
-	return enc.err
-}
+	stripped := false
+	for ii, e := range entries {
+		if !isAttributeEntry(e) || !strings.HasPrefix(e.label, enc.attributePrefix) {
+			continue
+		}
+		if name := strings.TrimPrefix(e.label, enc.attributePrefix); !taken[name] {
+			entries[ii].label = name
+			stripped = true
+		}
+	}
 
-// xyzzy004 - comment
-func (enc *Encoder) format(curNode *Node, lvl int) error {
-	var indentN = func(n int) {
-		if enc.indent {
-			for ii := 0; ii < n; ii++ {
-				enc.write(enc.indentText)
+	// Keep sorted output sorted on the keys actually written
+	if stripped && enc.sortOrder != None {
+		sort.SliceStable(entries, func(i, j int) bool {
+			if enc.sortOrder == Descending {
+				return entries[i].label > entries[j].label
 			}
+			return entries[i].label < entries[j].label
+		})
+	}
+}
+
+// isAttributeEntry returns whether all the nodes of e are attributes
+func isAttributeEntry(e entry) bool {
+	for _, ch := range e.children {
+		if !ch.IsAttribute {
+			return false
 		}
 	}
-	if curNode.HasChildren() {
-		enc.write("{")
-		if enc.indent {
-			enc.write("\n")
+	return len(e.children) > 0
+}
+
+// entryKey returns the key of e, its label unless it holds attributes and
+// SetAttributeKeyFunc or compact, for AttributedScalarCompact, says otherwise
+func (enc *Encoder) entryKey(e entry, compact bool) string {
+	if !isAttributeEntry(e) {
+		if key, ok := enc.keyRename[e.label]; ok {
+			return key
 		}
+		return e.label
+	}
+	name := strings.TrimPrefix(e.label, enc.attributePrefix)
+	if enc.attrKeyFunc != nil {
+		return enc.attrKeyFunc(name)
+	}
+	if compact {
+		return name
+	}
+	return e.label
+}
 
-		// xyzzy005 - must sort names before print?  Attributes must be in order for compare.
+// contentKey returns the label of the text of n when written as an object
+func (enc *Encoder) contentKey(n *Node) string {
+	if enc.mixedContentKey != "" && n.HasChildren() {
+		return enc.mixedContentKey
+	}
+	if enc.contentKeyName != "" {
+		return enc.contentKeyName
+	}
+	return enc.contentPrefix + "content"
+}
 
-		// Add data as an additional attibute (if any)
-		if len(curNode.Data) > 0 {
-			indentN(lvl + 1)
-			enc.write(`"`, enc.contentPrefix, "content", `": `, sanitiseString(curNode.Data), ", ")
-			if enc.indent {
-				enc.write("\n")
-			}
+// key returns the JSON object key, with its separator, written for label
+func (enc *Encoder) key(label string) string {
+	if enc.sanitizeKeys {
+		label = sanitizeKey(label)
+	}
+	k := label
+	if enc.dialect != DialectJSON5 || !isIdentifier(label) {
+		k = enc.quote(label)
+	}
+	if enc.minimalSeps {
+		return k + ":"
+	}
+	return k + ": "
+}
+
+// isIdentifier returns whether s is a JavaScript identifier, which JSON5
+// allows as an unquoted key
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || r == '$' || i > 0 && unicode.IsDigit(r)) {
+			return false
 		}
+	}
+	return s != ""
+}
 
-		sl := make([]string, 0, len(curNode.Children))
-		for label := range curNode.Children {
-			sl = append(sl, label)
+// endLast ends the last line of a multi-line object or array, after a
+// trailing comma in JSON5
+func (enc *Encoder) endLast() {
+	if enc.indent {
+		if enc.dialect == DialectJSON5 {
+			enc.write(",")
 		}
-		// fmt.Printf("sl->%s<-\n", sl)
-		if len(sl) > 1 {
-			// fmt.Printf("Must sort")
-			sort.Strings(sl)
+		enc.write("\n")
+	}
+}
+
+// comma returns the separator written between the members of an object
+func (enc *Encoder) comma() string {
+	if enc.indent {
+		return ",\n"
+	}
+	return enc.itemSep()
+}
+
+// itemSep returns the separator written between values on a same line
+func (enc *Encoder) itemSep() string {
+	if enc.minimalSeps {
+		return ","
+	}
+	return ", "
+}
+
+// sanitizeKey turns s into a valid JavaScript identifier
+func sanitizeKey(s string) string {
+	var buf bytes.Buffer
+	for i, r := range s {
+		if i == 0 && unicode.IsDigit(r) {
+			buf.WriteByte('_')
 		}
-		// fmt.Printf("sorted: sl->%s<-\n", sl)
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$' {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteByte('_')
+		}
+	}
+	if buf.Len() == 0 {
+		return "_"
+	}
+	return buf.String()
+}
 
-		com := ""
-		// for label, children := range curNode.Children {
-		for ii := range sl {
-			label, children := sl[ii], curNode.Children[sl[ii]]
-			enc.write(com)
-			indentN(lvl + 1)
-			enc.write(`"`, label, `": `)
-
-			if len(children) > 1 {
-				// Array
-				// xyzzy005 - may need to sort?
-				enc.write("[") // xyzzy006 - need to estimate if length is less than X- then one line - else - multi-line
-				com1 := ""
-				for _, ch := range children {
-					enc.write(com1)
-					enc.format(ch, lvl+2)
-					com1 = ", "
-				}
-				enc.write("]")
-			} else {
-				// Map
-				enc.format(children[0], lvl+1)
+// scalar returns the JSON encoding of the text data, with type inference when
+// infer is set
+func (enc *Encoder) scalar(data string, infer bool) string {
+	data = enc.normalizeDate(data)
+	if s, ok := enc.nonString(data, infer); ok {
+		return s
+	}
+	// Only strings are escaped: literals cannot hold the characters escaped
+	return enc.quote(data)
+}
+
+// writeScalar writes the JSON encoding of the text data, as scalar returns it
+func (enc *Encoder) writeScalar(data string, infer bool) {
+	data = enc.normalizeDate(data)
+	if s, ok := enc.nonString(data, infer); ok {
+		enc.write(s)
+		return
+	}
+	enc.writeQuoted(data)
+}
+
+// normalizeDate returns data rewritten by SetNormalizeDates if it is a date,
+// or as is
+func (enc *Encoder) normalizeDate(data string) string {
+	for _, layout := range enc.dateLayouts {
+		if t, err := time.Parse(layout, data); err == nil {
+			return t.Format(enc.dateOutput)
+		}
+	}
+	return data
+}
+
+// nonString returns the JSON encoding of the text data when it is not a plain
+// string, for scalar
+func (enc *Encoder) nonString(data string, infer bool) (string, bool) {
+	if enc.mongo {
+		if s, ok := enc.mongoScalar(data, infer); ok {
+			return s, true
+		}
+	}
+	if infer {
+		if enc.annotateAmbiguous && isAmbiguousNumber(data) {
+			return `{"$string": ` + enc.quote(data) + `}`, true
+		}
+		return enc.literal(data)
+	}
+	return "", false
+}
+
+// literal returns the JSON literal, a number, boolean or null, that data is
+// inferred as, written as is without escaping
+func (enc *Encoder) literal(data string) (string, bool) {
+	switch {
+	case data == "true" || data == "false" || data == "null":
+		return data, true
+	case isNumber(data):
+		if enc.numberFormat != nil {
+			if s, ok := enc.numberFormat(data); ok && s != "" {
+				return s, true
 			}
+			return "", false
+		}
+		if enc.floatFmt != 0 && strings.ContainsAny(data, ".eE") {
+			if f, err := strconv.ParseFloat(data, 64); err == nil {
+				return strconv.FormatFloat(f, enc.floatFmt, enc.floatPrec, 64), true
+			}
+		}
+		return data, true
+	}
+	return "", false
+}
 
-			if enc.indent {
-				com = ",\n"
-			} else {
-				com = ", "
+// isAmbiguousNumber returns whether data looks like a number but is kept as a
+// string by SetAnnotateAmbiguousTypes: a number with leading zeros, or an
+// integer a float64 does not hold exactly
+func isAmbiguousNumber(data string) bool {
+	digits := strings.TrimPrefix(data, "-")
+	if len(digits) > 1 && digits[0] == '0' && '0' <= digits[1] && digits[1] <= '9' {
+		rest := strings.TrimLeft(digits, "0")
+		return isNumber("0"+rest) || isNumber(rest)
+	}
+	if !isNumber(data) || strings.Trim(data, "-0123456789") != "" {
+		return false
+	}
+	i, err := strconv.ParseInt(data, 10, 64)
+	return err != nil || i > maxSafeInteger || i < -maxSafeInteger
+}
+
+// maxSafeInteger is the largest integer a float64 holds exactly, 2^53-1
+const maxSafeInteger = 1<<53 - 1
+
+// mongoScalar returns the extended JSON wrapper of data for
+// SetMongoExtendedJSON, if it needs one
+func (enc *Encoder) mongoScalar(data string, infer bool) (string, bool) {
+	if infer && isNumber(data) && strings.Trim(data, "-0123456789") == "" {
+		if i, err := strconv.ParseInt(data, 10, 64); err == nil {
+			if i > maxSafeInteger || i < -maxSafeInteger {
+				return `{"$numberLong": ` + enc.quote(data) + `}`, true
 			}
+			return "", false
+		}
+		return `{"$numberDecimal": ` + enc.quote(data) + `}`, true
+	}
+
+	layouts := enc.mongoDateLayouts
+	if layouts == nil {
+		layouts = defaultMongoDateLayouts
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, data); err == nil {
+			return `{"$date": ` + enc.quote(t.UTC().Format(time.RFC3339Nano)) + `}`, true
 		}
+	}
+	return "", false
+}
 
-		enc.write("\n")
-		indentN(lvl)
-		enc.write("}")
-	} else {
-		// TODO : Extract data type
-		enc.write(sanitiseString(curNode.Data))
+// defaultMongoDateLayouts are the dates recognized by SetMongoExtendedJSON
+// unless SetMongoDateLayouts is called
+var defaultMongoDateLayouts = []string{time.RFC3339Nano, "2006-01-02"}
+
+// infers returns whether type inference applies to the leaf n
+func (enc *Encoder) infers(n *Node) bool {
+	if n.Raw {
+		return false
+	}
+	if n.IsAttribute {
+		return enc.inferAttrTypes
+	}
+	return enc.inferTypes
+}
+
+// scalarKind returns the JSON type of data as written by scalar: 's' for
+// strings, 'n' for numbers, 'b' for booleans and 'z' for null
+func (enc *Encoder) scalarKind(data string, infer bool) byte {
+	switch s := enc.scalar(data, infer); {
+	case s == "true" || s == "false":
+		return 'b'
+	case s == "null":
+		return 'z'
+	case s == "" || s[0] == '"':
+		return 's'
+	case s[0] == '{':
+		// Extended JSON wrappers
+		return 'o'
 	}
+	return 'n'
+}
 
-	return nil
+// isHomogeneous returns whether all the leaves among children have the same
+// JSON type
+func (enc *Encoder) isHomogeneous(children Nodes) bool {
+	var kind byte
+	for _, ch := range children {
+		if ch.Null || ch.HasChildren() {
+			continue
+		}
+		k := enc.scalarKind(ch.Data, enc.infers(ch))
+		if kind != 0 && k != kind {
+			return false
+		}
+		kind = k
+	}
+	return true
+}
+
+// quote returns s as a JSON string
+func (enc *Encoder) quote(s string) string {
+	return sanitiseStringOpt(s, enc.asciiOnly)
+}
+
+// writeQuoted writes s as a JSON string, escaped in a buffer reused from one
+// string to the next
+func (enc *Encoder) writeQuoted(s string) {
+	enc.strBuf.Reset()
+	sanitiseStringInto(&enc.strBuf, s, enc.asciiOnly)
+	enc.writeBytes(enc.strBuf.Bytes())
+}
+
+// isNumber returns whether s is a number in JSON syntax
+func isNumber(s string) bool {
+	i := 0
+	digits := func() int {
+		start := i
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		return i - start
+	}
+
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	if i < len(s) && s[i] == '0' {
+		i++
+	} else if digits() == 0 {
+		return false
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		if digits() == 0 {
+			return false
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+// indentN writes the line prefix and n levels of indentation, if indenting
+func (enc *Encoder) indentN(n int) {
+	if enc.indent {
+		enc.write(enc.linePrefix)
+		for ii := 0; ii < n; ii++ {
+			enc.write(enc.indentText)
+		}
+	}
+}
+
+// render returns the JSON encoding of curNode instead of writing it out
+func (enc *Encoder) render(curNode *Node, lvl int) ([]byte, error) {
+	w, onEmit := enc.w, enc.onEmit
+	buf := new(bytes.Buffer)
+	enc.w, enc.onEmit = buf, nil
+	err := enc.format(curNode, lvl)
+	enc.w, enc.onEmit = w, onEmit
+	return buf.Bytes(), err
 }
 
 // xyzzy004 - comment
 func (enc *Encoder) write(s ...string) {
+	if enc.emitPending && len(s) > 0 && s[0] != "" {
+		enc.emit(s[0][0])
+	}
 	for _, ss := range s {
-		enc.w.Write([]byte(ss))
+		// Without a copy to []byte when w is an io.StringWriter
+		io.WriteString(enc.w, ss)
+		enc.wrote(len(ss))
+	}
+}
+
+// writeBytes is write for a single []byte
+func (enc *Encoder) writeBytes(b []byte) {
+	if enc.emitPending && len(b) > 0 {
+		enc.emit(b[0])
+	}
+	enc.w.Write(b)
+	enc.wrote(len(b))
+}
+
+// wrote counts n bytes written, for SetAutoFlush
+func (enc *Encoder) wrote(n int) {
+	if enc.flushEvery > 0 {
+		if enc.unflushed += n; enc.unflushed >= enc.flushEvery {
+			enc.autoFlush()
+		}
+	}
+}
+
+// tracksPath returns whether the keys of the members being written are kept
+// in emitPath, for SetOnEmit and SetEmitPath
+func (enc *Encoder) tracksPath() bool {
+	return enc.onEmit != nil || enc.pathKey != ""
+}
+
+// member writes the key of an object member, whose value is written next
+func (enc *Encoder) member(key string) {
+	enc.write(enc.key(key))
+	if enc.tracksPath() {
+		enc.emitPath = append(enc.emitPath, key)
+		enc.emitPending = enc.onEmit != nil
+	}
+}
+
+// endMember ends the member started by member, once its value is written
+func (enc *Encoder) endMember() {
+	if enc.tracksPath() {
+		enc.emitPath = enc.emitPath[:len(enc.emitPath)-1]
+	}
+}
+
+// index marks the members written next as those of the i-th item of the array
+// value of the member key, the current one, or of key itself when i < 0
+func (enc *Encoder) index(key string, i int) {
+	if !enc.tracksPath() || len(enc.emitPath) == 0 {
+		return
+	}
+	if i >= 0 {
+		key += "[" + strconv.Itoa(i) + "]"
+	}
+	enc.emitPath[len(enc.emitPath)-1] = key
+}
+
+// emit calls the SetOnEmit callback for the pending member, whose value starts
+// with c
+func (enc *Encoder) emit(c byte) {
+	enc.emitPending = false
+	kind := ValueNumber
+	switch c {
+	case '{':
+		kind = ValueObject
+	case '[':
+		kind = ValueArray
+	case '"':
+		kind = ValueString
+	case 't', 'f':
+		kind = ValueBool
+	case 'n':
+		kind = ValueNull
+	}
+	last := len(enc.emitPath) - 1
+	enc.onEmit(enc.emitPath[:last], enc.emitPath[last], kind)
+}
+
+// autoFlush flushes the output for SetAutoFlush, keeping the first error
+func (enc *Encoder) autoFlush() {
+	if err := enc.Flush(); err != nil && enc.err == nil {
+		enc.err = err
 	}
 }
 
@@ -162,8 +2724,19 @@ var hex = "0123456789abcdef"
 // xyzzy004 - comment
 // see also: https://golang.org/src/html/escape.go
 func sanitiseString(s string) string {
+	return sanitiseStringOpt(s, false)
+}
+
+// sanitiseStringOpt is sanitiseString, with all non-ASCII characters escaped
+// when asciiOnly is set
+func sanitiseStringOpt(s string, asciiOnly bool) string {
 	var buf bytes.Buffer
+	sanitiseStringInto(&buf, s, asciiOnly)
+	return buf.String()
+}
 
+// sanitiseStringInto writes the JSON string of sanitiseStringOpt to buf
+func sanitiseStringInto(buf *bytes.Buffer, s string, asciiOnly bool) {
 	buf.WriteByte('"')
 	start := 0
 	for i := 0; i < len(s); {
@@ -211,6 +2784,15 @@ func sanitiseString(s string) string {
 			start = i
 			continue
 		}
+		if asciiOnly {
+			if start < i {
+				buf.WriteString(s[start:i])
+			}
+			writeNonASCII(buf, c)
+			i += size
+			start = i
+			continue
+		}
 		// U+2028 is LINE SEPARATOR.
 		// U+2029 is PARAGRAPH SEPARATOR.
 		// They are both technically valid characters in JSON strings,
@@ -234,5 +2816,42 @@ func sanitiseString(s string) string {
 		buf.WriteString(s[start:])
 	}
 	buf.WriteByte('"')
-	return buf.String()
+}
+
+// writeNonASCII writes the escape of the non-ASCII character c, a surrogate
+// pair outside of the BMP
+func writeNonASCII(buf *bytes.Buffer, c rune) {
+	if r1, r2 := utf16.EncodeRune(c); r1 != utf8.RuneError {
+		writeRuneEscape(buf, r1)
+		writeRuneEscape(buf, r2)
+	} else {
+		writeRuneEscape(buf, c)
+	}
+}
+
+// escapeNonASCII returns the JSON b, from json.Marshal, with its non-ASCII
+// characters escaped, for SetASCIIOnly. They may only be found in strings,
+// where escapes mean the same.
+func escapeNonASCII(b []byte) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(b); {
+		if b[i] < utf8.RuneSelf {
+			buf.WriteByte(b[i])
+			i++
+			continue
+		}
+		c, size := utf8.DecodeRune(b[i:])
+		writeNonASCII(&buf, c)
+		i += size
+	}
+	return buf.Bytes()
+}
+
+// writeRuneEscape writes the \uXXXX escape of r, which must be in the BMP
+func writeRuneEscape(buf *bytes.Buffer, r rune) {
+	buf.WriteString(`\u`)
+	buf.WriteByte(hex[r>>12&0xF])
+	buf.WriteByte(hex[r>>8&0xF])
+	buf.WriteByte(hex[r>>4&0xF])
+	buf.WriteByte(hex[r&0xF])
 }
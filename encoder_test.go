@@ -1,9 +1,20 @@
 package xml2json
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	sj "github.com/bitly/go-simplejson"
 	"github.com/stretchr/testify/assert"
@@ -99,3 +110,1933 @@ func TestEncode(t *testing.T) {
 	enc.err = fmt.Errorf("Testing if error provided is returned")
 	assert.Error(enc.Encode(nil))
 }
+
+// TestEncodeForceArray ensures that single elements can be forced into arrays
+func TestEncodeForceArray(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	root.AddChild("bookList", &Node{Data: "a"})
+	root.AddChild("item1", &Node{Data: "b"})
+	root.AddChild("item", &Node{Data: "c"})
+	root.AddChild("name", &Node{Data: "d"})
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf).SetForceArray("name")
+	assert.NoError(enc.SetForceArrayPattern(`.*List|item\d+`))
+	assert.NoError(enc.Encode(root))
+	assert.JSONEq(`{"bookList": ["a"], "item1": ["b"], "item": "c", "name": ["d"]}`, buf.String())
+
+	assert.Error(enc.SetForceArrayPattern(`item(`))
+}
+
+// TestEncodeDedupeArrayElements ensures that identical array elements are dropped
+func TestEncodeDedupeArrayElements(t *testing.T) {
+	assert := assert.New(t)
+
+	item := func(id string) *Node {
+		n := &Node{}
+		n.AddChild("-id", &Node{Data: id})
+		return n
+	}
+
+	root := &Node{}
+	root.AddChild("item", item("1"))
+	root.AddChild("item", item("2"))
+	root.AddChild("item", item("1"))
+	root.AddChild("tag", &Node{Data: "a"})
+	root.AddChild("tag", &Node{Data: "b"})
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.JSONEq(`{"item": [{"-id": "1"}, {"-id": "2"}, {"-id": "1"}], "tag": ["a", "b"]}`, buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetDedupeArrayElements(true).Encode(root))
+	assert.JSONEq(`{"item": [{"-id": "1"}, {"-id": "2"}], "tag": ["a", "b"]}`, buf.String())
+}
+
+// TestMarshal ensures that Marshal and MarshalIndent work like their encoding/json counterparts
+func TestMarshal(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	root.AddChild("a", &Node{Data: "1"})
+	b := &Node{}
+	b.AddChild("c", &Node{Data: "2"})
+	root.AddChild("b", b)
+
+	res, err := Marshal(root)
+	assert.NoError(err)
+	assert.Equal(`{"a": "1", "b": {"c": "2"}}`, string(res))
+	assert.False(bytes.HasSuffix(res, []byte("\n")))
+
+	res, err = MarshalIndent(root, "//", "\t")
+	assert.NoError(err)
+	assert.Equal("{\n//\t\"a\": \"1\",\n//\t\"b\": {\n//\t\t\"c\": \"2\"\n//\t}\n//}", string(res))
+}
+
+// TestEncodeLinePrefix ensures that nested lines start with the prefix and then the indentation
+func TestEncodeLinePrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Node{}
+	c.AddChild("d", &Node{Data: "x"})
+	b := &Node{}
+	b.AddChild("c", c)
+	root := &Node{}
+	root.AddChild("b", b)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetIndent("  ").SetLinePrefix("> ").Encode(root))
+	assert.Equal(`{
+>   "b": {
+>     "c": {
+>       "d": "x"
+>     }
+>   }
+> }
+`, buf.String())
+
+	// Without indentation the prefix is not used
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetLinePrefix("> ").Encode(root))
+	assert.NotContains(buf.String(), ">")
+}
+
+// TestEncodePath ensures that only the selected subtree is encoded
+func TestEncodePath(t *testing.T) {
+	assert := assert.New(t)
+
+	book := func(title string) *Node {
+		n := &Node{}
+		n.AddChild("title", &Node{Data: title})
+		return n
+	}
+	books := &Node{}
+	books.AddChild("book", book("Go"))
+	books.AddChild("book", book("XML"))
+	root := &Node{}
+	root.AddChild("library", books)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).EncodePath(root, "library.book[1]"))
+	assert.JSONEq(`{"title": "XML"}`, buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).EncodePath(root, "library.book.title"))
+	assert.JSONEq(`["Go", "XML"]`, buf.String())
+
+	buf.Reset()
+	err := NewEncoder(buf).EncodePath(root, "library.magazine")
+	assert.True(errors.Is(err, ErrNotFound))
+	assert.Empty(buf.String())
+}
+
+// TestEncodeSanitizeKeys ensures that keys can be turned into identifiers
+func TestEncodeSanitizeKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	n := &Node{Data: "x"}
+	n.AddChild("-id", &Node{Data: "1"})
+	root.AddChild("3d-model", n)
+	root.AddChild("file.name", &Node{Data: "a"})
+	root.AddChild("ok_$", &Node{Data: "b"})
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetSanitizeKeys(true).Encode(root))
+	assert.JSONEq(`{"_3d_model": {"_content": "x", "_id": "1"}, "file_name": "a", "ok_$": "b"}`, buf.String())
+
+	table := []struct {
+		in       string
+		expected string
+	}{
+		{in: "foo", expected: "foo"},
+		{in: "1", expected: "_1"},
+		{in: "a:b", expected: "a_b"},
+		{in: "über", expected: "über"},
+		{in: "", expected: "_"},
+	}
+	for _, scenario := range table {
+		assert.Equal(scenario.expected, sanitizeKey(scenario.in))
+	}
+}
+
+// TestEncodeNDJSON ensures that each record is written on its own line
+func TestEncodeNDJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	rows := &Node{}
+	for _, id := range []string{"1", "2", "3"} {
+		row := &Node{}
+		row.AddChild("id", &Node{Data: id})
+		rows.AddChild("row", row)
+	}
+	root.AddChild("rows", rows)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetIndent("  ").EncodeNDJSON(root, "rows.row"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(lines, 3)
+	for ii, line := range lines {
+		assert.JSONEq(fmt.Sprintf(`{"id": "%d"}`, ii+1), line)
+	}
+
+	assert.True(errors.Is(NewEncoder(buf).EncodeNDJSON(root, "rows.col"), ErrNotFound))
+}
+
+// TestEncodePreserveOrder ensures that keys can follow the document order
+func TestEncodePreserveOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<doc b="1"><zeta>z</zeta><alpha>a</alpha><zeta>y</zeta></doc>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetPreserveOrder(true).Encode(root))
+	assert.Equal(`{"doc": {"-b": "1", "zeta": ["z", "y"], "alpha": "a"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"doc": {"-b": "1", "alpha": "a", "zeta": ["z", "y"]}}`+"\n", buf.String())
+}
+
+// TestEncodeSortOrder ensures that all the sort orders are honored
+func TestEncodeSortOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	root.AddChild("b", &Node{Data: "2"})
+	root.AddChild("c", &Node{Data: "3"})
+	root.AddChild("a", &Node{Data: "1"})
+
+	table := []struct {
+		order    SortOrder
+		expected string
+	}{
+		{order: Ascending, expected: `{"a": "1", "b": "2", "c": "3"}`},
+		{order: Descending, expected: `{"c": "3", "b": "2", "a": "1"}`},
+		{order: None, expected: `{"b": "2", "c": "3", "a": "1"}`},
+	}
+
+	for _, scenario := range table {
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetSortOrder(scenario.order).Encode(root))
+		assert.Equal(scenario.expected+"\n", buf.String())
+	}
+}
+
+// TestEncodeKeyClashPolicy ensures that attribute/element clashes follow the policy
+func TestEncodeKeyClashPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<a id="1"><id>2</id><name>x</name></a>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetAttributePrefix("")
+	assert.NoError(dec.Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.JSONEq(`{"a": {"id": ["1", "2"], "name": "x"}}`, buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetKeyClashPolicy(ClashSuffixAttribute).Encode(root))
+	assert.JSONEq(`{"a": {"id": "2", "id_attr": "1", "name": "x"}}`, buf.String())
+
+	buf.Reset()
+	err := NewEncoder(buf).SetKeyClashPolicy(ClashError).Encode(root)
+	assert.True(errors.Is(err, ErrKeyClash))
+}
+
+// TestEncodeSmartAttributePrefix ensures that the attribute prefix is only kept on clashes
+func TestEncodeSmartAttributePrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<doc><a id="1" z="2"><name>x</name></a><b id="1"><id>2</id></b></doc>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetSmartAttributePrefix(true).Encode(root))
+	assert.Equal(`{"doc": {"a": {"id": "1", "name": "x", "z": "2"}, "b": {"-id": "1", "id": "2"}}}`+"\n", buf.String())
+}
+
+// TestEncodeEnvelope ensures that the document can be wrapped with metadata
+func TestEncodeEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	root.AddChild("a", &Node{Data: "1"})
+
+	meta := map[string]interface{}{
+		"$schema":  "http://example.com/schema.json",
+		"version":  2,
+		`"quoted"`: []string{"x"},
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetEnvelope(meta).Encode(root))
+	assert.Equal(`{"\"quoted\"": ["x"], "$schema": "http://example.com/schema.json", "version": 2, "data": {"a": "1"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetIndent("  ").SetEnvelope(meta).SetEnvelopeKey("doc").Encode(root))
+	assert.Equal(`{
+  "\"quoted\"": ["x"],
+  "$schema": "http://example.com/schema.json",
+  "version": 2,
+  "doc": {
+    "a": "1"
+  }
+}
+`, buf.String())
+
+	assert.Error(NewEncoder(buf).SetEnvelope(map[string]interface{}{"f": func() {}}).Encode(root))
+}
+
+// TestEncodeInferTypes ensures that numbers, booleans and null are recognized
+func TestEncodeInferTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for _, v := range []string{"5", "-1.5e3", "0", "007", "1.", "+1", "true", "null", "yes", ""} {
+		root.AddChild("v", &Node{Data: v})
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"v": [5, -1.5e3, 0, "007", "1.", "+1", true, null, "yes", ""]}`+"\n", buf.String())
+}
+
+// TestEncodeNumberFormat ensures that recognized numbers can be reformatted
+func TestEncodeNumberFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for _, v := range []string{"5", "5.1", "-2.345", "1e400", "abc"} {
+		root.AddChild("price", &Node{Data: v})
+	}
+
+	twoDecimals := func(raw string) (string, bool) {
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return "", false
+		}
+		return strconv.FormatFloat(f, 'f', 2, 64), true
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).SetNumberFormat(twoDecimals).Encode(root))
+	assert.Equal(`{"price": [5.00, 5.10, -2.35, "1e400", "abc"]}`+"\n", buf.String())
+
+	// An empty number keeps the original text
+	empty := func(raw string) (string, bool) { return "", true }
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).SetNumberFormat(empty).SetHomogeneousArrays(true).Encode(root))
+	assert.Equal(`{"price": ["5", "5.1", "-2.345", "1e400", "abc"]}`+"\n", buf.String())
+}
+
+// TestEncodeArrayLimit ensures that arrays can be truncated and flagged
+func TestEncodeArrayLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for _, v := range []string{"a", "b", "c", "d"} {
+		root.AddChild("item", &Node{Data: v})
+	}
+	root.AddChild("tag", &Node{Data: "x"})
+	root.AddChild("tag", &Node{Data: "y"})
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetArrayLimit(2).Encode(root))
+	assert.Equal(`{"item": ["a", "b"], "tag": ["x", "y"]}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetArrayLimit(2).SetArrayTruncationSuffix("_truncated").Encode(root))
+	assert.Equal(`{"item": ["a", "b"], "item_truncated": 4, "tag": ["x", "y"]}`+"\n", buf.String())
+
+	// Duplicates are dropped before the limit applies
+	root = &Node{}
+	for _, v := range []string{"a", "a", "a", "b"} {
+		root.AddChild("item", &Node{Data: v})
+	}
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetArrayLimit(2).SetDedupeArrayElements(true).Encode(root))
+	assert.Equal(`{"item": ["a", "b"]}`+"\n", buf.String())
+}
+
+// TestEncodeCollapseSingletonArrays ensures that the array decision matrix is honored
+func TestEncodeCollapseSingletonArrays(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	root.AddChild("dup", &Node{Data: "a"})
+	root.AddChild("dup", &Node{Data: "a"})
+	root.AddChild("forced", &Node{Data: "b"})
+	root.AddChild("forced", &Node{Data: "b"})
+	root.AddChild("one", &Node{Data: "c"})
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetDedupeArrayElements(true).SetForceArray("forced").Encode(root))
+	assert.Equal(`{"dup": ["a"], "forced": ["b"], "one": "c"}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetDedupeArrayElements(true).SetForceArray("forced").SetCollapseSingletonArrays(true).Encode(root))
+	assert.Equal(`{"dup": "a", "forced": ["b"], "one": "c"}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetArrayLimit(1).SetCollapseSingletonArrays(true).SetArrayTruncationSuffix("_n").Encode(root))
+	assert.Equal(`{"dup": "a", "dup_n": 2, "forced": "b", "forced_n": 2, "one": "c"}`+"\n", buf.String())
+
+	// Only SetArrayLimit truncates
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetDedupeArrayElements(true).SetArrayTruncationSuffix("_n").Encode(root))
+	assert.Equal(`{"dup": ["a"], "forced": ["b"], "one": "c"}`+"\n", buf.String())
+}
+
+// TestEncodeArrayAsObject ensures that repeated elements can be keyed by id
+func TestEncodeArrayAsObject(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<library><book id="b1"><title>Go</title></book><book id="b2"><title>XML</title></book><name>x</name></library>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	byID := func(i int, n *Node) string {
+		if ids := n.Children["-id"]; len(ids) > 0 {
+			return ids[0].Data
+		}
+		return strconv.Itoa(i)
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetArrayAsObject(byID).Encode(root))
+	assert.JSONEq(`{
+	  "library": {
+	    "book": {
+	      "b1": {"-id": "b1", "title": "Go"},
+	      "b2": {"-id": "b2", "title": "XML"}
+	    },
+	    "name": "x"
+	  }
+	}`, buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetArrayAsObject(byID).SetIndent("  ").Encode(root))
+	assert.Equal(`{
+  "library": {
+    "book": {
+      "b1": {
+        "-id": "b1",
+        "title": "Go"
+      },
+      "b2": {
+        "-id": "b2",
+        "title": "XML"
+      }
+    },
+    "name": "x"
+  }
+}
+`, buf.String())
+}
+
+// TestEncodeWithHash ensures that identical trees give identical digests
+func TestEncodeWithHash(t *testing.T) {
+	assert := assert.New(t)
+
+	digest := func(s string) ([]byte, []byte) {
+		root := &Node{}
+		assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+		buf := new(bytes.Buffer)
+		h := sha256.New()
+		assert.NoError(NewEncoder(buf).EncodeWithHash(root, h))
+		sum := sha256.Sum256(buf.Bytes())
+		assert.Equal(sum[:], h.Sum(nil))
+		return h.Sum(nil), buf.Bytes()
+	}
+
+	d1, out1 := digest(`<a><b>1</b><c x="2"/></a>`)
+	d2, out2 := digest(`<a><c x="2"/><b>1</b></a>`)
+	d3, _ := digest(`<a><b>2</b><c x="2"/></a>`)
+	assert.Equal(out1, out2)
+	assert.Equal(d1, d2)
+	assert.NotEqual(d1, d3)
+}
+
+// TestEncodeASCIIOnly ensures that non-ASCII characters are escaped
+func TestEncodeASCIIOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	root.AddChild("cjk", &Node{Data: "漢字"})
+	root.AddChild("emoji", &Node{Data: "a😀b"})
+	root.AddChild("zürich", &Node{Data: " �"})
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetASCIIOnly(true).Encode(root))
+	assert.Equal(`{"cjk": "\u6f22\u5b57", "emoji": "a\ud83d\ude00b", "z\u00fcrich": "\u2028\ufffd"}`+"\n", buf.String())
+
+	res := map[string]string{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &res))
+	assert.Equal("a😀b", res["emoji"])
+	assert.Equal("漢字", res["cjk"])
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetASCIIOnly(true).SetEnvelope(map[string]interface{}{"k": "日本😀", "n": []string{"é"}}).
+		Encode(NewElement("a", NewNode("1"))))
+	assert.Equal(`{"k": "\u65e5\u672c\ud83d\ude00", "n": ["\u00e9"], "data": {"a": "1"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Contains(buf.String(), "漢字")
+}
+
+// TestEncodeInferAttributeTypes ensures that attribute inference is separate
+func TestEncodeInferAttributeTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<x count="5" code="007" ok="true">12</x>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"x": {"#content": 12, "-code": "007", "-count": "5", "-ok": "true"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).SetInferAttributeTypes(true).Encode(root))
+	assert.Equal(`{"x": {"#content": 12, "-code": "007", "-count": 5, "-ok": true}}`+"\n", buf.String())
+}
+
+// TestEncoderReset ensures that a reset encoder keeps its options
+func TestEncoderReset(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	root.AddChild("b", &Node{Data: "1"})
+	root.AddChild("a", &Node{Data: "2"})
+
+	buf1 := new(bytes.Buffer)
+	enc := NewEncoder(buf1).SetSortOrder(Descending).SetInferTypes(true)
+	assert.NoError(enc.Encode(root))
+	enc.err = fmt.Errorf("previous error")
+
+	buf2 := new(bytes.Buffer)
+	enc.Reset(buf2)
+	assert.NoError(enc.Encode(root))
+	assert.Equal(`{"b": 1, "a": 2}`+"\n", buf1.String())
+	assert.Equal(buf1.String(), buf2.String())
+}
+
+// TestEncodeHomogeneousArrays ensures that mixed arrays are kept as strings
+func TestEncodeHomogeneousArrays(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for _, v := range []string{"1", "abc", "2"} {
+		root.AddChild("mixed", &Node{Data: v})
+	}
+	for _, v := range []string{"1", "2.5"} {
+		root.AddChild("numbers", &Node{Data: v})
+	}
+	obj := &Node{}
+	obj.AddChild("a", &Node{Data: "3"})
+	root.AddChild("objects", obj)
+	root.AddChild("objects", &Node{Data: "4"})
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"mixed": [1, "abc", 2], "numbers": [1, 2.5], "objects": [{"a": 3}, 4]}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).SetHomogeneousArrays(true).Encode(root))
+	assert.Equal(`{"mixed": ["1", "abc", "2"], "numbers": [1, 2.5], "objects": [{"a": 3}, 4]}`+"\n", buf.String())
+}
+
+// TestEncodeRootKey ensures that the output can be put under a fixed key
+func TestEncodeRootKey(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := &Node{}
+	doc.AddChild("a", &Node{Data: "1"})
+	root := &Node{}
+	root.AddChild("osm", doc)
+
+	two := &Node{}
+	two.AddChild("a", &Node{Data: "1"})
+	two.AddChild("b", &Node{Data: "2"})
+
+	table := []struct {
+		root     *Node
+		wrap     bool
+		expected string
+	}{
+		{root: root, expected: `{"data": {"a": "1"}}`},
+		{root: root, wrap: true, expected: `{"data": {"osm": {"a": "1"}}}`},
+		{root: two, expected: `{"data": {"a": "1", "b": "2"}}`},
+		{root: &Node{Data: "x"}, expected: `{"data": "x"}`},
+	}
+
+	for _, scenario := range table {
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetRootKey("data").SetRootKeyWrap(scenario.wrap).Encode(scenario.root))
+		assert.Equal(scenario.expected+"\n", buf.String())
+	}
+}
+
+// TestEncodeContentKeys ensures that the content keys follow their precedence
+func TestEncodeContentKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	price := &Node{Data: "9.99"}
+	price.AddChild("-currency", &Node{Data: "USD"})
+	root := &Node{}
+	root.AddChild("price", price)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"price": {"#content": "9.99", "-currency": "USD"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetContentKey("#text").Encode(root))
+	assert.Equal(`{"price": {"#text": "9.99", "-currency": "USD"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetContentKey("#text").SetMixedContentKey("_").Encode(root))
+	assert.Equal(`{"price": {"_": "9.99", "-currency": "USD"}}`+"\n", buf.String())
+
+	assert.Equal("#text", NewEncoder(nil).SetContentKey("#text").SetMixedContentKey("_").contentKey(&Node{Data: "leaf"}))
+}
+
+// TestCompact ensures that the compact output has no insignificant whitespace
+func TestCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<a x="1">text<b>2</b><b>3</b><c><d>4</d></c></a>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	assert.Equal(`{"a":{"#content":"text","-x":"1","b":["2","3"],"c":{"d":"4"}}}`, Compact(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetMinimalSeparators(true).SetEnvelope(map[string]interface{}{"v": 1}).Encode(root))
+	assert.Equal(`{"v":1,"data":{"a":{"#content":"text","-x":"1","b":["2","3"],"c":{"d":"4"}}}}`+"\n", buf.String())
+}
+
+// TestEncodeSeparators ensures the exact bytes written around separators
+func TestEncodeSeparators(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<a x="1">text<b>2</b><b>3</b></a>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"a": {"#content": "text", "-x": "1", "b": ["2", "3"]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetMinimalSeparators(true).Encode(root))
+	assert.Equal(`{"a":{"#content":"text","-x":"1","b":["2","3"]}}`+"\n", buf.String())
+
+	// No trailing spaces at the end of indented lines
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetIndent("\t").Encode(root))
+	assert.Equal("{\n\t\"a\": {\n\t\t\"#content\": \"text\",\n\t\t\"-x\": \"1\",\n\t\t\"b\": [\"2\", \"3\"]\n\t}\n}\n", buf.String())
+}
+
+// TestEncodeSeparateTextAndChildren ensures that every element is written as an object
+func TestEncodeSeparateTextAndChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<a x="1">text<b>2</b><b>3</b><c><d><e>deep</e><f/></d></c></a>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetSeparateTextAndChildren(true).Encode(root))
+	assert.Equal(`{"a": {"#content": "text", "-x": "1", "b": [{"#content": "2"}, {"#content": "3"}], "c": {"d": {"e": {"#content": "deep"}, "f": {}}}}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetSeparateTextAndChildren(true).SetIndent("  ").Encode(root))
+	assert.Contains(buf.String(), "\"e\": {\n          \"#content\": \"deep\"\n        },\n")
+}
+
+// TestEncodeGroupByLang ensures that localized elements are grouped by language
+func TestEncodeGroupByLang(t *testing.T) {
+	assert := assert.New(t)
+
+	encode := func(s string) string {
+		root := &Node{}
+		assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetGroupByLang(true).Encode(root))
+		return buf.String()
+	}
+
+	assert.Equal(`{"doc": {"title": {"en": "Hi", "fr": "Salut"}}}`+"\n",
+		encode(`<doc><title xml:lang="en">Hi</title><title xml:lang="fr">Salut</title></doc>`))
+	assert.Equal(`{"doc": {"title": {"en": {"#content": "Hi", "-id": "1"}, "fr": "Salut"}}}`+"\n",
+		encode(`<doc><title xml:lang="en" id="1">Hi</title><title xml:lang="fr">Salut</title></doc>`))
+
+	// Single elements are not grouped
+	assert.Equal(`{"doc": {"title": {"#content": "Hi", "-lang": "en"}}}`+"\n",
+		encode(`<doc><title xml:lang="en">Hi</title></doc>`))
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<doc><title xml:lang="en">Hi</title><title xml:lang="fr">Salut</title></doc>`)).Decode(root))
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetGroupByLang(true).SetIndent("  ").Encode(root))
+	assert.Equal("{\n  \"doc\": {\n    \"title\": {\n      \"en\": \"Hi\",\n      \"fr\": \"Salut\"\n    }\n  }\n}\n", buf.String())
+
+	// Mixed lang and no-lang siblings are not grouped
+	assert.Equal(`{"doc": {"title": [{"#content": "Hi", "-lang": "en"}, "Hello"]}}`+"\n",
+		encode(`<doc><title xml:lang="en">Hi</title><title>Hello</title></doc>`))
+	assert.Equal(`{"doc": {"title": [{"#content": "Hi", "-lang": "en"}, {"#content": "Hey", "-lang": "en"}]}}`+"\n",
+		encode(`<doc><title xml:lang="en">Hi</title><title xml:lang="en">Hey</title></doc>`))
+}
+
+// TestEncodeCanonical ensures that equivalent documents have the same canonical encoding
+func TestEncodeCanonical(t *testing.T) {
+	assert := assert.New(t)
+
+	canonical := func(s string) string {
+		root := &Node{}
+		assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+		b, err := EncodeCanonical(root)
+		assert.NoError(err)
+		return string(b)
+	}
+
+	a := canonical(`<r z="1" a="2">text<y>1.50</y><b>-0</b><c>1E3</c><d>0.0000001</d><e>007</e><f><![CDATA[<&>]]></f></r>`)
+	assert.Equal(`{"r":{"#content":"text","-a":"2","-z":"1","b":0,"c":1000,"d":1e-7,"e":"007","f":"\u003c\u0026\u003e","y":1.5}}`, a)
+	assert.Equal(a, canonical(`<r a="2" z="1">
+		<f>&lt;&amp;&gt;</f><e>007</e><d>1e-7</d><c>1000</c><b>0</b><y>1.5</y>text
+	</r>`))
+
+	assert.Equal(`{"n":[12345678901234567890,"1e999"]}`, canonical(`<n>12345678901234567890</n><n>1e999</n>`))
+	assert.Equal(`{"n":[1e+21,-1.5e+300]}`, canonical(`<n>1000000000000000000000.0</n><n>-15e299</n>`))
+}
+
+// TestEncodeWrapScalarRoot ensures that scalar documents can be written as objects
+func TestEncodeWrapScalarRoot(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<title>Hello</title>`)).Decode(root))
+	title := root.Get("title")[0]
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(title))
+	assert.Equal(`"Hello"`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetWrapScalarRoot(true).Encode(title))
+	assert.Equal(`{"#content": "Hello"}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetWrapScalarRoot(true).SetContentKey("#text").Encode(&Node{Null: true}))
+	assert.Equal(`{"#text": null}`+"\n", buf.String())
+
+	// Objects are left alone
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetWrapScalarRoot(true).Encode(root))
+	assert.Equal(`{"title": "Hello"}`+"\n", buf.String())
+}
+
+// TestEncodeMaxDepth ensures that deep trees give an error instead of a crash
+func TestEncodeMaxDepth(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a><b>1</b><b>2</b></a>`)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetMaxEncodeDepth(3).Encode(root))
+	assert.Equal(`{"a": {"b": ["1", "2"]}}`+"\n", buf.String())
+	assert.Equal(ErrMaxEncodeDepth, NewEncoder(new(bytes.Buffer)).SetMaxEncodeDepth(2).Encode(root))
+
+	deep := &Node{}
+	for n, i := deep, 0; i < 100000; i++ {
+		c := &Node{}
+		n.AddChild("n", c)
+		n = c
+	}
+	enc := NewEncoder(new(bytes.Buffer)).SetMaxEncodeDepth(1000)
+	assert.Equal(ErrMaxEncodeDepth, enc.Encode(deep))
+	assert.Equal(ErrMaxEncodeDepth, enc.Encode(root))
+	assert.Equal(0, enc.depth)
+}
+
+// TestEncodeJSONLD ensures that "@" keys survive the encoding, for JSON-LD output
+func TestEncodeJSONLD(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<Person id="http://example.org/alice" type="Person"><name language="en">Alice</name><knows id="http://example.org/bob"/></Person>`
+
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetAttributePrefix("@")
+	assert.NoError(dec.Decode(root))
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf).SetAttributePrefix("@").SetContentKey("@value").SetSortOrder(None)
+	assert.NoError(enc.Encode(root.Get("Person")[0]))
+	assert.Equal(`{"@id": "http://example.org/alice", "@type": "Person", "name": {"@value": "Alice", "@language": "en"}, "knows": {"@id": "http://example.org/bob"}}`+"\n", buf.String())
+
+	var v map[string]interface{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &v))
+	assert.Equal("Alice", v["name"].(map[string]interface{})["@value"])
+
+	// The other key options keep "@" as well
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetAttributePrefix("@").SetContentKey("@value").SetASCIIOnly(true).
+		SetKeyClashPolicy(ClashSuffixAttribute).SetMinimalSeparators(true).Encode(root.Get("Person.name")[0]))
+	assert.Equal(`{"@value":"Alice","@language":"en"}`+"\n", buf.String())
+}
+
+// TestEncodeElementEncoder ensures that elements can be written by custom encoders
+func TestEncodeElementEncoder(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<event><name>Launch</name><date>2023-01-01</date><date>2023-02-01</date><size>3</size></event>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	date := func(n *Node) (json.RawMessage, error) {
+		d, err := time.Parse("2006-01-02", n.Data)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]interface{}{"iso": d.Format(time.RFC3339), "unix": d.Unix()})
+	}
+	size := func(n *Node) (json.RawMessage, error) {
+		return json.RawMessage(strconv.Quote(n.Data + " items")), nil
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetElementEncoder("date", date).SetElementEncoder("size", size).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"event": {"date": [{"iso":"2023-01-01T00:00:00Z","unix":1672531200}, {"iso":"2023-02-01T00:00:00Z","unix":1675209600}], "name": "Launch", "size": "3 items"}}`+"\n", buf.String())
+
+	root.Get("event.date")[1].Data = "soon"
+	err := NewEncoder(new(bytes.Buffer)).SetElementEncoder("date", date).Encode(root)
+	assert.ErrorContains(err, `element "date"`)
+
+	bad := func(n *Node) (json.RawMessage, error) { return json.RawMessage("{"), nil }
+	assert.Error(NewEncoder(new(bytes.Buffer)).SetElementEncoder("name", bad).Encode(root))
+}
+
+// TestEncodeAttributedScalarLayout ensures the shapes of elements with attributes and text
+func TestEncodeAttributedScalarLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<item><price currency="USD">9.99</price><weight unit="kg" approx="yes">1.5</weight><size unit="cm">10</size><size unit="in">4</size><name>Box</name><dim unit="mm"><w>3</w></dim></item>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	encode := func(layout AttributedScalarLayout) string {
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetAttributedScalarLayout(layout).Encode(root))
+		return buf.String()
+	}
+
+	assert.Equal(`{"item": {"dim": {"-unit": "mm", "w": "3"}, "name": "Box", "price": {"#content": "9.99", "-currency": "USD"}, `+
+		`"size": [{"#content": "10", "-unit": "cm"}, {"#content": "4", "-unit": "in"}], "weight": {"#content": "1.5", "-approx": "yes", "-unit": "kg"}}}`+"\n",
+		encode(AttributedScalarNested))
+	assert.Equal(`{"item": {"dim": {"-unit": "mm", "w": "3"}, "name": "Box", "price": {"_": "9.99", "currency": "USD"}, `+
+		`"size": [{"_": "10", "unit": "cm"}, {"_": "4", "unit": "in"}], "weight": {"_": "1.5", "approx": "yes", "unit": "kg"}}}`+"\n",
+		encode(AttributedScalarCompact))
+	assert.Equal(`{"item": {"dim": {"-unit": "mm", "w": "3"}, "name": "Box", "price": "9.99", "price_currency": "USD", `+
+		`"size": [{"_": "10", "unit": "cm"}, {"_": "4", "unit": "in"}], "weight": "1.5", "weight_approx": "yes", "weight_unit": "kg"}}`+"\n",
+		encode(AttributedScalarPromoted))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetAttributedScalarLayout(AttributedScalarCompact).SetMixedContentKey("value").
+		SetInferTypes(true).Encode(root.Get("item.price")[0]))
+	assert.Equal(`{"value": 9.99, "currency": "USD"}`+"\n", buf.String())
+
+	// Raw elements are never inferred
+	root = &Node{}
+	dec := NewDecoder(strings.NewReader(`<r><n a="x">42</n></r>`))
+	dec.SetRawElements("n")
+	assert.NoError(dec.Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetAttributedScalarLayout(AttributedScalarPromoted).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"r": {"n": "42", "n_a": "x"}}`+"\n", buf.String())
+}
+
+// flushRecorder records the length of its buffer at each flush
+type flushRecorder struct {
+	bytes.Buffer
+	flushes []int
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushes = append(f.flushes, f.Len())
+	return nil
+}
+
+// TestEncodeArrayFlushEvery ensures that the output is flushed every n array items
+func TestEncodeArrayFlushEvery(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for i := 0; i < 10; i++ {
+		root.AddChild("item", &Node{Data: strconv.Itoa(i)})
+	}
+	root.AddChild("pair", &Node{Data: "a"})
+	root.AddChild("pair", &Node{Data: "b"})
+
+	f := &flushRecorder{}
+	assert.NoError(NewEncoder(f).SetArrayFlushEvery(4).Encode(root))
+	assert.Equal(`{"item": ["0", "1", "2", "3", "4", "5", "6", "7", "8", "9"], "pair": ["a", "b"]}`+"\n", f.String())
+	s := f.String()
+	assert.Equal([]int{
+		strings.Index(s, `"3"`) + len(`"3"`),
+		strings.Index(s, `"7"`) + len(`"7"`),
+		len(s),
+	}, f.flushes)
+
+	f = &flushRecorder{}
+	assert.NoError(NewEncoder(f).SetArrayFlushEvery(1).Encode(root))
+	assert.Len(f.flushes, 10+2+1)
+}
+
+// TestEncodeArrayStreamThreshold ensures that long arrays are flushed item by
+// item once the threshold is reached
+func TestEncodeArrayStreamThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for i := 0; i < 6; i++ {
+		root.AddChild("item", &Node{Data: strconv.Itoa(i)})
+	}
+	root.AddChild("pair", &Node{Data: "a"})
+	root.AddChild("pair", &Node{Data: "b"})
+
+	f := &flushRecorder{}
+	assert.NoError(NewEncoder(f).SetArrayStreamThreshold(4).Encode(root))
+	assert.Equal(`{"item": ["0", "1", "2", "3", "4", "5"], "pair": ["a", "b"]}`+"\n", f.String())
+	s := f.String()
+	assert.Equal([]int{
+		strings.Index(s, `"3"`) + len(`"3"`),
+		strings.Index(s, `"4"`) + len(`"4"`),
+		strings.Index(s, `"5"`) + len(`"5"`),
+		len(s),
+	}, f.flushes)
+
+	f = &flushRecorder{}
+	assert.NoError(NewEncoder(f).SetArrayStreamThreshold(6).Encode(root))
+	assert.Equal([]int{len(s)}, f.flushes)
+}
+
+// TestEncodeAutoFlush ensures that the output is flushed as it is written
+func TestEncodeAutoFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for i := 0; i < 100; i++ {
+		root.AddChild("item", &Node{Data: strconv.Itoa(i)})
+	}
+
+	f := &flushRecorder{}
+	assert.NoError(NewEncoder(f).Encode(root))
+	assert.Empty(f.flushes)
+
+	f = &flushRecorder{}
+	enc := NewEncoder(f).SetAutoFlush(64)
+	assert.NoError(enc.Encode(root))
+	assert.True(len(f.flushes) > 5)
+	for i := 1; i < len(f.flushes)-1; i++ {
+		assert.True(f.flushes[i]-f.flushes[i-1] >= 64)
+	}
+	assert.Equal(f.Len(), f.flushes[len(f.flushes)-1])
+
+	// http.ResponseWriter flushes to the client
+	rec := httptest.NewRecorder()
+	assert.NoError(NewEncoder(rec).SetAutoFlush(1024).Encode(root))
+	assert.True(rec.Flushed)
+
+	// Through a bufio.Writer, the output is there after Flush only
+	out := new(bytes.Buffer)
+	bw := bufio.NewWriter(out)
+	enc = NewEncoder(bw)
+	assert.NoError(enc.Encode(&Node{Data: "x"}))
+	assert.Equal(0, out.Len())
+	assert.NoError(enc.Flush())
+	assert.Equal(`"x"`+"\n", out.String())
+}
+
+// TestEncodeOmitEmpty ensures that empty elements are left out, cascading to their parents
+func TestEncodeOmitEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	encode := func(s string) string {
+		root := &Node{}
+		assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetOmitEmpty(true).Encode(root))
+		return buf.String()
+	}
+
+	assert.Equal(`{"a": {"b": "1", "e": {"-x": ""}}}`+"\n",
+		encode(`<a><b>1</b><c/><d><d1/><d2><d3></d3></d2></d><e x=""/></a>`))
+	assert.Equal(`{"a": {"b": ["1", "2"]}}`+"\n", encode(`<a><b>1</b><b/><b>2</b></a>`))
+	assert.Equal(`{"a": {"b": "1"}}`+"\n", encode(`<a><b>1</b><b><c/></b></a>`))
+	assert.Equal(`{"a": "text"}`+"\n", encode(`<a>text<b/><c><d/></c></a>`))
+	assert.Equal(`{}`+"\n", encode(`<a><b/><c><d/></c></a>`))
+
+	root := &Node{}
+	root.AddChild("a", &Node{Null: true})
+	root.AddChild("b", &Node{})
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetOmitEmpty(true).SetIndent("  ").Encode(root))
+	assert.Equal("{\n  \"a\": null\n}\n", buf.String())
+}
+
+// TestEncodeOmitEmptyContent ensures that whitespace content is left out of containers
+func TestEncodeOmitEmptyContent(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<list xml:space="preserve">
+  <item id="1"> </item>
+  <item id="2">b</item>
+</list>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"list": {"#content": "\n", "-space": "preserve", "item": [{"#content": " ", "-id": "1"}, {"#content": "b", "-id": "2"}]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetOmitEmptyContent(true).Encode(root))
+	assert.Equal(`{"list": {"-space": "preserve", "item": [{"#content": " ", "-id": "1"}, {"#content": "b", "-id": "2"}]}}`+"\n", buf.String())
+
+	// Not preserved, the same tree loses it
+	root.Get("list.item")[0].Preserved = false
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetOmitEmptyContent(true).Encode(root))
+	assert.Equal(`{"list": {"-space": "preserve", "item": [{"-id": "1"}, {"#content": "b", "-id": "2"}]}}`+"\n", buf.String())
+}
+
+// TestEncodePreservedWhitespace ensures that preserved whitespace is written, escaped
+func TestEncodePreservedWhitespace(t *testing.T) {
+	assert := assert.New(t)
+
+	s := "<doc><code xml:space=\"preserve\" lang=\"go\">\t\n  </code><pre xml:space=\"preserve\"> <b>x</b> </pre><trimmed lang=\"go\">\t\n  </trimmed></doc>"
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+	assert.True(root.Get("doc.code")[0].Preserved)
+	assert.False(root.Get("doc.trimmed")[0].Preserved)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetOmitEmptyContent(true).Encode(root))
+	assert.Equal(`{"doc": {"code": {"#content": "\t\n  ", "-lang": "go", "-space": "preserve"}, "pre": {"-space": "preserve", "b": "x"}, "trimmed": {"-lang": "go"}}}`+"\n", buf.String())
+}
+
+// TestEncodeArrayItemsPerLine ensures that arrays wrap after the given number of scalars
+func TestEncodeArrayItemsPerLine(t *testing.T) {
+	assert := assert.New(t)
+
+	encode := func(root *Node, n int) string {
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetIndent("  ").SetArrayItemsPerLine(n).SetInferTypes(true).Encode(root))
+		return buf.String()
+	}
+
+	root := &Node{}
+	for i := 1; i <= 7; i++ {
+		root.AddChild("n", &Node{Data: strconv.Itoa(i)})
+	}
+	assert.Equal("{\n  \"n\": [1, 2, 3, 4, 5, 6, 7]\n}\n", encode(root, 0))
+	assert.Equal("{\n  \"n\": [\n    1, 2, 3,\n    4, 5, 6,\n    7\n  ]\n}\n", encode(root, 3))
+	assert.Equal("{\n  \"n\": [\n    1, 2, 3, 4, 5, 6, 7\n  ]\n}\n", encode(root, 7))
+	assert.Equal("{\n  \"n\": [\n    1,\n    2,\n    3,\n    4,\n    5,\n    6,\n    7\n  ]\n}\n", encode(root, 1))
+
+	// Objects get a line each
+	obj := &Node{}
+	obj.AddChild("k", &Node{Data: "v"})
+	mixed := &Node{}
+	mixed.AddChild("m", &Node{Data: "1"})
+	mixed.AddChild("m", &Node{Data: "2"})
+	mixed.AddChild("m", obj)
+	mixed.AddChild("m", &Node{Data: "3"})
+	mixed.AddChild("m", &Node{Null: true})
+	assert.Equal("{\n  \"m\": [\n    1, 2,\n    {\n      \"k\": \"v\"\n    },\n    3, null\n  ]\n}\n", encode(mixed, 4))
+
+	// No effect without indentation
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetArrayItemsPerLine(3).Encode(root))
+	assert.Equal(`{"n": ["1", "2", "3", "4", "5", "6", "7"]}`+"\n", buf.String())
+}
+
+// TestEncodeAttributeAsArray ensures that token list attributes are written as arrays
+func TestEncodeAttributeAsArray(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<div class="card  wide
+	dark" rel="next"><p class="lead">x</p><p class="">y</p><p class=" ">z</p></div>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetAttributeAsArray("class").Encode(root))
+	assert.Equal(`{"div": {"-class": ["card", "wide", "dark"], "-rel": "next", "p": [{"#content": "x", "-class": ["lead"]}, {"#content": "y", "-class": []}, {"#content": "z", "-class": []}]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetAttributeAsArray("class").SetAttributeAsArray("rel").SetSingleTokenScalar(true).Encode(root))
+	assert.Equal(`{"div": {"-class": ["card", "wide", "dark"], "-rel": "next", "p": [{"#content": "x", "-class": "lead"}, {"#content": "y", "-class": []}, {"#content": "z", "-class": []}]}}`+"\n", buf.String())
+
+	// Elements with the same name are left alone
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a><class>b c</class></a>`)).Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetAttributePrefix("").SetAttributeAsArray("class").Encode(root))
+	assert.Equal(`{"a": {"class": "b c"}}`+"\n", buf.String())
+}
+
+// TestEncodeAttributeAsArrayInferred ensures that tokens are inferred as attribute values are
+func TestEncodeAttributeAsArrayInferred(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<f flags="true false null" sizes="1 2.5 007" one="3" id="7"/>`)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf).SetAttributeAsArray("flags").SetAttributeAsArray("sizes").SetAttributeAsArray("one")
+	assert.NoError(enc.SetInferTypes(true).Encode(root))
+	assert.Equal(`{"f": {"-flags": ["true", "false", "null"], "-id": "7", "-one": ["3"], "-sizes": ["1", "2.5", "007"]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(enc.SetInferAttributeTypes(true).Encode(root))
+	assert.Equal(`{"f": {"-flags": [true, false, null], "-id": 7, "-one": [3], "-sizes": [1, 2.5, "007"]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(enc.SetSingleTokenScalar(true).Encode(root))
+	assert.Equal(`{"f": {"-flags": [true, false, null], "-id": 7, "-one": 3, "-sizes": [1, 2.5, "007"]}}`+"\n", buf.String())
+}
+
+// TestEncodeMongoExtendedJSON ensures that large integers and dates get extended JSON wrappers
+func TestEncodeMongoExtendedJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<order id="9007199254740993"><count>42</count><big>900719925474099300000</big><neg>-9007199254740992</neg><at>2023-01-15T10:30:00+02:00</at><day>2023-01-01</day><code>00123</code><note>soon</note></order>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetMongoExtendedJSON(true).SetInferTypes(true).SetSortOrder(None).Encode(root))
+	assert.Equal(`{"order": {"-id": "9007199254740993", "count": 42, "big": {"$numberDecimal": "900719925474099300000"}, `+
+		`"neg": {"$numberLong": "-9007199254740992"}, "at": {"$date": "2023-01-15T08:30:00Z"}, "day": {"$date": "2023-01-01T00:00:00Z"}, `+
+		`"code": "00123", "note": "soon"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetMongoExtendedJSON(true).SetInferTypes(true).SetInferAttributeTypes(true).
+		SetMongoDateLayouts("02/01/2006").Encode(root.Get("order")[0]))
+	assert.Contains(buf.String(), `"-id": {"$numberLong": "9007199254740993"}`)
+	assert.Contains(buf.String(), `"day": "2023-01-01"`)
+
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<d>15/01/2023</d>`)).Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetMongoExtendedJSON(true).SetMongoDateLayouts("02/01/2006").Encode(root))
+	assert.Equal(`{"d": {"$date": "2023-01-15T00:00:00Z"}}`+"\n", buf.String())
+}
+
+// TestEncodeArrayWrapperStyle ensures that repeated elements can keep their name on each entry
+func TestEncodeArrayWrapperStyle(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<doc><list id="1"><item>a</item><item>b</item><name>n</name></list><one><item>c</item></one></doc>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetArrayWrapperStyle(ArrayMerged).Encode(root))
+	assert.Equal(`{"doc": {"list": {"-id": "1", "item": ["a", "b"], "name": "n"}, "one": {"item": "c"}}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetArrayWrapperStyle(ArrayWrapped).Encode(root))
+	assert.Equal(`{"doc": {"list": [{"-id": "1"}, {"item": "a"}, {"item": "b"}, {"name": "n"}], "one": {"item": "c"}}}`+"\n", buf.String())
+
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<p>text<b>1</b><b><i>2</i></b></p>`)).Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetArrayWrapperStyle(ArrayWrapped).SetMinimalSeparators(true).Encode(root))
+	assert.Equal(`{"p":[{"#content":"text"},{"b":"1"},{"b":{"i":"2"}}]}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetArrayWrapperStyle(ArrayWrapped).SetIndent("  ").Encode(root))
+	assert.Equal(`{
+  "p": [{
+      "#content": "text"
+    }, {
+      "b": "1"
+    }, {
+      "b": {
+        "i": "2"
+      }
+    }]
+}
+`, buf.String())
+}
+
+// TestEstimateSize ensures that the estimated size is close to the actual one
+func TestEstimateSize(t *testing.T) {
+	assert := assert.New(t)
+
+	var sb strings.Builder
+	sb.WriteString(`<catalog version="2">`)
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&sb, `<book id="b%d"><title>Title number %d</title><price>%d.99</price><tag>a</tag><tag>b</tag></book>`, i, i, i)
+	}
+	sb.WriteString(`<note>plain text</note></catalog>`)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(sb.String())).Decode(root))
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithIndent("  ")},
+		{WithIndent("\t"), WithInferTypes(true), WithContentKey("#text")},
+	} {
+		enc := NewEncoder(nil)
+		for _, opt := range opts {
+			opt(enc)
+		}
+		buf := new(bytes.Buffer)
+		enc.w = buf
+		assert.NoError(enc.Encode(root))
+
+		estimate := EstimateSize(root, opts...)
+		assert.InDelta(buf.Len(), estimate, float64(buf.Len())/100, "estimate %d, actual %d", estimate, buf.Len())
+	}
+
+	small := &Node{}
+	small.AddChild("a", &Node{Data: "b"})
+	assert.Equal(len(`{"a": "b"}`+"\n"), EstimateSize(small))
+	assert.Equal(0, EstimateSize(nil))
+}
+
+// TestEncodeFloatFormat ensures that inferred floats are reformatted
+func TestEncodeFloatFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	for _, v := range []string{"1000000.0", "0.125", "2.50", "1e3", "42", "1e999"} {
+		root.AddChild("n", &Node{Data: v})
+	}
+
+	encode := func(fmt byte, prec int) string {
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetInferTypes(true).SetFloatFormat(fmt, prec).Encode(root))
+		return buf.String()
+	}
+
+	assert.Equal(`{"n": [1000000, 0.125, 2.5, 1000, 42, 1e999]}`+"\n", encode('f', -1))
+	assert.Equal(`{"n": [1000000.00, 0.12, 2.50, 1000.00, 42, 1e999]}`+"\n", encode('f', 2))
+	assert.Equal(`{"n": [1e+06, 1.25e-01, 2.5e+00, 1e+03, 42, 1e999]}`+"\n", encode('e', -1))
+	assert.Equal(`{"n": [1e+06, 0.125, 2.5, 1000, 42, 1e999]}`+"\n", encode('g', -1))
+
+	// Not without inference, and not over SetNumberFormat
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetFloatFormat('e', 2).Encode(root))
+	assert.Contains(buf.String(), `"2.50"`)
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).SetFloatFormat('e', 2).
+		SetNumberFormat(func(raw string) (string, bool) { return raw, true }).Encode(root))
+	assert.Contains(buf.String(), `2.50`)
+}
+
+// BenchmarkEncodeStrings encodes a document made of string leaves, some of
+// them with characters to escape
+func BenchmarkEncodeStrings(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString(`<library>`)
+	for ii := 0; ii < 1000; ii++ {
+		fmt.Fprintf(&sb, `<book><title>Title %d</title><author>Author &amp; co</author><summary>A "quoted" summary, line %d</summary></book>`, ii, ii)
+	}
+	sb.WriteString(`</library>`)
+	root := &Node{}
+	if err := NewDecoder(strings.NewReader(sb.String())).Decode(root); err != nil {
+		b.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		buf.Reset()
+		enc.Reset(buf)
+		if err := enc.Encode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeBuffer(b *testing.B) {
+	root := &Node{}
+	if err := NewDecoder(strings.NewReader(benchmarkDocument(1000))).Decode(root); err != nil {
+		b.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		buf.Reset()
+		if err := NewEncoder(buf).Encode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeBuilder(b *testing.B) {
+	root := &Node{}
+	if err := NewDecoder(strings.NewReader(benchmarkDocument(1000))).Decode(root); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		var sb strings.Builder
+		if err := NewEncoder(&sb).Encode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeBufio(b *testing.B) {
+	root := &Node{}
+	if err := NewDecoder(strings.NewReader(benchmarkDocument(1000))).Decode(root); err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(io.Discard)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		if err := NewEncoder(w).Encode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestEncodeNilRootBehavior ensures the output for nil and empty roots
+func TestEncodeNilRootBehavior(t *testing.T) {
+	assert := assert.New(t)
+
+	empty := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(``)).Decode(empty))
+
+	for _, tc := range []struct {
+		behavior   NilRootBehavior
+		nil, empty string
+		err        error
+	}{
+		{NilRootWriteNothing, "", `""` + "\n", nil},
+		{NilRootWriteNull, "null\n", "null\n", nil},
+		{NilRootWriteEmptyObject, "{}\n", "{}\n", nil},
+		{NilRootReturnError, "", "", ErrEmptyRoot},
+	} {
+		buf := new(bytes.Buffer)
+		assert.Equal(tc.err, NewEncoder(buf).SetNilRootBehavior(tc.behavior).Encode(nil))
+		assert.Equal(tc.nil, buf.String())
+
+		buf.Reset()
+		if tc.err == nil {
+			assert.NoError(NewEncoder(buf).SetNilRootBehavior(tc.behavior).Encode(empty))
+		} else {
+			assert.ErrorIs(NewEncoder(buf).SetNilRootBehavior(tc.behavior).Encode(empty), tc.err)
+		}
+		assert.Equal(tc.empty, buf.String())
+	}
+
+	// Other roots are not affected
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetNilRootBehavior(NilRootReturnError).Encode(&Node{Null: true}))
+	assert.Equal("null\n", buf.String())
+}
+
+// TestEncodeLiteralsNotEscaped ensures that only strings go through escaping
+func TestEncodeLiteralsNotEscaped(t *testing.T) {
+	assert := assert.New(t)
+
+	enc := NewEncoder(nil).SetInferTypes(true)
+	for _, data := range []string{"12", "-1.5e+3", "0", "true", "null"} {
+		s, ok := enc.literal(data)
+		assert.True(ok)
+		assert.Equal(data, s)
+		assert.Equal(data, enc.scalar(data, true))
+	}
+
+	// Look-alikes holding characters to escape are strings
+	for data, want := range map[string]string{
+		"1LS":   `"1\u2028"`,
+		"1PS0":  `"1\u20290"`,
+		"<1>":   `"\u003c1\u003e"`,
+		"tr&ue": `"tr\u0026ue"`,
+	} {
+		data = strings.NewReplacer("LS", "\u2028", "PS", "\u2029").Replace(data)
+		_, ok := enc.literal(data)
+		assert.False(ok)
+		assert.Equal(want, enc.scalar(data, true))
+	}
+
+	// Numbers from SetNumberFormat are written as returned
+	enc.SetNumberFormat(func(raw string) (string, bool) { return raw + "0", true })
+	assert.Equal("1.50", enc.scalar("1.5", true))
+}
+
+// TestEncodeGroupConsecutiveOnly ensures that interleaved repeats keep their order
+func TestEncodeGroupConsecutiveOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<body><p>one</p><p>two</p><img src="x"/><p>three</p><ul><li>a</li><li>b</li></ul></body>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"body": {"img": {"-src": "x"}, "p": ["one", "two", "three"], "ul": {"li": ["a", "b"]}}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetGroupConsecutiveOnly(true).Encode(root))
+	assert.Equal(`{"body": [{"p": ["one", "two"]}, {"img": {"-src": "x"}}, {"p": "three"}, {"ul": {"li": ["a", "b"]}}]}`+"\n", buf.String())
+
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a id="1">t<b/><c/><b/></a>`)).Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetGroupConsecutiveOnly(true).SetForceArray("c").Encode(root))
+	assert.Equal(`{"a": [{"#content": "t"}, {"-id": "1"}, {"b": ""}, {"c": [""]}, {"b": ""}]}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetGroupConsecutiveOnly(true).SetIndent("  ").Encode(root))
+	assert.Equal(`{
+  "a": [{
+      "#content": "t"
+    }, {
+      "-id": "1"
+    }, {
+      "b": ""
+    }, {
+      "c": ""
+    }, {
+      "b": ""
+    }]
+}
+`, buf.String())
+}
+
+// TestEncodeAttributeKeyFunc ensures that attribute keys can use any convention
+func TestEncodeAttributeKeyFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<book id="1" lang="en"><title>Go</title><id>isbn</id></book>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	encode := func(fn func(string) string) string {
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetAttributeKeyFunc(fn).Encode(root))
+		return buf.String()
+	}
+
+	assert.Equal(`{"book": {"-id": "1", "-lang": "en", "id": "isbn", "title": "Go"}}`+"\n", encode(nil))
+	assert.Equal(`{"book": {"id@attr": "1", "lang@attr": "en", "id": "isbn", "title": "Go"}}`+"\n",
+		encode(func(name string) string { return name + "@attr" }))
+	assert.Equal(`{"book": {"attr:id": "1", "attr:lang": "en", "id": "isbn", "title": "Go"}}`+"\n",
+		encode(func(name string) string { return "attr:" + name }))
+
+	// Decoded without a prefix, attributes are still told apart
+	root = &Node{}
+	dec := NewDecoder(strings.NewReader(`<a x="1"><y>2</y></a>`))
+	dec.SetAttributePrefix("")
+	assert.NoError(dec.Decode(root))
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetAttributePrefix("").SetAttributeKeyFunc(strings.ToUpper).Encode(root))
+	assert.Equal(`{"a": {"X": "1", "y": "2"}}`+"\n", buf.String())
+}
+
+// TestEncodeBinaryElements ensures that binary content is converted between hex and base64
+func TestEncodeBinaryElements(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<file><name>a.bin</name><digest>48656c6c6f2c20
+	776f726c6421</digest><data>SGVs
+	bG8=</data></file>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetBinaryElements(HexBinary, "digest").SetBinaryElements(Base64Binary, "data").Encode(root))
+	assert.Equal(`{"file": {"data": "48656c6c6f", "digest": "SGVsbG8sIHdvcmxkIQ==", "name": "a.bin"}}`+"\n", buf.String())
+
+	err := NewEncoder(new(bytes.Buffer)).SetBinaryElements(HexBinary, "name").Encode(root)
+	assert.ErrorContains(err, `element "name"`)
+	assert.Error(NewEncoder(new(bytes.Buffer)).SetBinaryElements(Base64Binary, "digest").Encode(root))
+}
+
+// TestEncodeDialect ensures that JSON5 output drops the quotes of identifier keys and adds trailing commas
+func TestEncodeDialect(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<book id="1"><title>Go</title><x-ref>a</x-ref><x-ref>b</x-ref><_2nd>c</_2nd></book>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetDialect(DialectJSON).Encode(root))
+	assert.Equal(`{"book": {"-id": "1", "_2nd": "c", "title": "Go", "x-ref": ["a", "b"]}}`+"\n", buf.String())
+	assert.True(json.Valid(buf.Bytes()))
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetDialect(DialectJSON5).Encode(root))
+	assert.Equal(`{book: {"-id": "1", _2nd: "c", title: "Go", "x-ref": ["a", "b"]}}`+"\n", buf.String())
+	assert.False(json.Valid(buf.Bytes()))
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetDialect(DialectJSON5).SetIndent("  ").SetArrayItemsPerLine(1).Encode(root))
+	assert.Equal(`{
+  book: {
+    "-id": "1",
+    _2nd: "c",
+    title: "Go",
+    "x-ref": [
+      "a",
+      "b",
+    ],
+  },
+}
+`, buf.String())
+
+	assert.True(isIdentifier("$ref"))
+	assert.True(isIdentifier("café"))
+	assert.False(isIdentifier("2nd"))
+	assert.False(isIdentifier(""))
+}
+
+// TestEncodeOnEmit ensures that the callback sees each key with its path and kind
+func TestEncodeOnEmit(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<catalog><book id="1"><title>Go</title></book><book id="2"><title>XML</title><price>9.5</price><used>true</used></book><note>null</note></catalog>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	var emitted []string
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf).SetInferTypes(true).SetOnEmit(func(path []string, key string, kind ValueKind) {
+		emitted = append(emitted, strings.Join(append(path, key), ".")+" "+kind.String())
+	})
+	assert.NoError(enc.Encode(root))
+	assert.Equal(`{"catalog": {"book": [{"-id": "1", "title": "Go"}, {"-id": "2", "price": 9.5, "title": "XML", "used": true}], "note": null}}`+"\n", buf.String())
+	assert.Equal([]string{
+		"catalog object",
+		"catalog.book array",
+		"catalog.book[0].-id string",
+		"catalog.book[0].title string",
+		"catalog.book[1].-id string",
+		"catalog.book[1].price number",
+		"catalog.book[1].title string",
+		"catalog.book[1].used bool",
+		"catalog.note null",
+	}, emitted)
+}
+
+// TestEncodeKeyRename ensures that elements can be renamed, onto a sibling's key too
+func TestEncodeKeyRename(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<soap:Envelope xmlns:soap="urn:soap"><soap:Body id="1"><item>a</item></soap:Body></soap:Envelope>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	// Elements are decoded under their local name
+	rename := map[string]string{"Envelope": "envelope", "Body": "body", "id": "ignored"}
+	assert.NoError(NewEncoder(buf).SetKeyRename(rename).Encode(root))
+	assert.Equal(`{"envelope": {"-soap": "urn:soap", "body": {"-id": "1", "item": "a"}}}`+"\n", buf.String())
+
+	// Renamed onto the key of a sibling
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a><old>1</old><new>2</new><other>3</other></a>`)).Decode(root))
+	rename = map[string]string{"old": "new"}
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetKeyRename(rename).Encode(root))
+	assert.Equal(`{"a": {"new": ["2", "1"], "other": "3"}}`+"\n", buf.String())
+	assert.Len(root.Children["a"][0].Children["new"], 1)
+
+	err := NewEncoder(new(bytes.Buffer)).SetKeyRename(rename).SetKeyClashPolicy(ClashError).Encode(root)
+	assert.ErrorIs(err, ErrKeyClash)
+	assert.ErrorContains(err, `"new" and "old" both have the key "new"`)
+
+	// Sorted on the new keys, promoted attributes included
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<r><zz>1</zz><aa>2</aa><p unit="kg">3</p></r>`)).Decode(root))
+	rename = map[string]string{"zz": "b", "p": "weight"}
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetKeyRename(rename).Encode(root))
+	assert.Equal(`{"r": {"aa": "2", "b": "1", "weight": {"#content": "3", "-unit": "kg"}}}`+"\n", buf.String())
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetKeyRename(rename).SetSortOrder(Descending).
+		SetAttributedScalarLayout(AttributedScalarPromoted).Encode(root))
+	assert.Equal(`{"r": {"weight": "3", "weight_unit": "kg", "b": "1", "aa": "2"}}`+"\n", buf.String())
+}
+
+// TestEncodeResultWrapper ensures that the document goes under the result key, inside the envelope
+func TestEncodeResultWrapper(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<user id="7"><name>Ann</name></user>`)).Decode(root))
+
+	encode := func(enc *Encoder) string {
+		buf := new(bytes.Buffer)
+		enc.Reset(buf)
+		assert.NoError(enc.Encode(root))
+		return buf.String()
+	}
+
+	assert.Equal(`{"result": {"user": {"-id": "7", "name": "Ann"}}}`+"\n",
+		encode(NewEncoder(nil).SetResultWrapper("result")))
+	assert.Equal(`{"result": {"data": {"-id": "7", "name": "Ann"}}}`+"\n",
+		encode(NewEncoder(nil).SetResultWrapper("result").SetRootKey("data")))
+
+	meta := map[string]interface{}{"version": 2}
+	assert.Equal(`{"version": 2, "data": {"result": {"user": {"-id": "7", "name": "Ann"}}}}`+"\n",
+		encode(NewEncoder(nil).SetResultWrapper("result").SetEnvelope(meta)))
+	assert.Equal(`{"version": 2, "data": {"result": {"user": {"-id": "7", "name": "Ann"}}}}`+"\n",
+		encode(NewEncoder(nil).SetEnvelope(meta).SetResultWrapper("result")))
+
+	// Scalars and null are wrapped too
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetResultWrapper("result").Encode(&Node{Null: true}))
+	assert.Equal(`{"result": null}`+"\n", buf.String())
+}
+
+// TestEncodeAnnotateAmbiguousTypes ensures that numeric-looking strings are annotated
+func TestEncodeAnnotateAmbiguousTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<r code="007"><zip>01234</zip><neg>-0012.5</neg><zero>0</zero><small>9007199254740991</small><big>9007199254740993</big><huge>-123456789012345678901234</huge><word>0x1F</word><fraction>0.5</fraction></r>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"r": {"-code": "007", "big": 9007199254740993, "fraction": 0.5, "huge": -123456789012345678901234, "neg": "-0012.5", "small": 9007199254740991, "word": "0x1F", "zero": 0, "zip": "01234"}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).SetAnnotateAmbiguousTypes(true).Encode(root))
+	assert.Equal(`{"r": {"-code": "007", "big": {"$string": "9007199254740993"}, "fraction": 0.5, "huge": {"$string": "-123456789012345678901234"}, "neg": {"$string": "-0012.5"}, "small": 9007199254740991, "word": "0x1F", "zero": 0, "zip": {"$string": "01234"}}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).SetInferAttributeTypes(true).SetAnnotateAmbiguousTypes(true).Encode(root.Get("r.-code")[0]))
+	assert.Equal(`{"$string": "007"}`+"\n", buf.String())
+
+	// Not inferred, nothing is ambiguous
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetAnnotateAmbiguousTypes(true).Encode(root.Get("r.zip")[0]))
+	assert.Equal(`"01234"`+"\n", buf.String())
+}
+
+// TestEncodeEmitPath ensures that each object carries its path
+func TestEncodeEmitPath(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<catalog><book id="1"><title>Go</title></book><book id="2"><title>XML</title><author><name>Ann</name></author></book></catalog>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetEmitPath("_path").Encode(root))
+	assert.Equal(`{"catalog": {"_path": "catalog", "book": [`+
+		`{"_path": "catalog.book[0]", "-id": "1", "title": "Go"}, `+
+		`{"_path": "catalog.book[1]", "-id": "2", "author": {"_path": "catalog.book[1].author", "name": "Ann"}, "title": "XML"}]}}`+"\n", buf.String())
+
+	var doc map[string]interface{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &doc))
+	author := doc["catalog"].(map[string]interface{})["book"].([]interface{})[1].(map[string]interface{})["author"]
+	assert.Equal("catalog.book[1].author", author.(map[string]interface{})["_path"])
+
+	// Paths are made of the keys written
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetEmitPath("@path").SetRootKey("data").SetIndent("  ").Encode(root.Get("catalog.book")[1]))
+	assert.Equal(`{
+  "data": {
+    "@path": "data",
+    "-id": "2",
+    "author": {
+      "@path": "data.author",
+      "name": "Ann"
+    },
+    "title": "XML"
+  }
+}
+`, buf.String())
+}
+
+// TestEncodeJoinChildren ensures that simple repeated children are joined, and others left alone
+func TestEncodeJoinChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<post><tags><t>go</t><t>xml</t></tags><one><t>json</t></one><ids><t>1</t><t><b>2</b></t></ids><empty/></post>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf).SetJoinChildren("tags", "t", ",").SetJoinChildren("one", "t", ",")
+	assert.NoError(enc.Encode(root))
+	assert.Equal(`{"post": {"empty": "", "ids": {"t": ["1", {"b": "2"}]}, "one": "json", "tags": "go,xml"}}`+"\n", buf.String())
+	assert.Empty(enc.Warnings())
+
+	// Complex children are not joined
+	buf.Reset()
+	enc = NewEncoder(buf).SetJoinChildren("ids", "t", " ").SetJoinChildren("empty", "t", " ")
+	assert.NoError(enc.Encode(root))
+	assert.Equal(`{"post": {"empty": "", "ids": {"t": ["1", {"b": "2"}]}, "one": {"t": "json"}, "tags": {"t": ["go", "xml"]}}}`+"\n", buf.String())
+	assert.Equal([]string{
+		`element "empty": not only "t" children, not joined`,
+		`element "ids": "t" child is not a scalar, not joined`,
+	}, enc.Warnings())
+
+	enc.Reset(new(bytes.Buffer))
+	assert.Empty(enc.Warnings())
+}
+
+// TestEncodeMixedContentArrayShape ensures that repeated mixed-content elements can share a shape
+func TestEncodeMixedContentArrayShape(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<body><p>plain</p><p>some <b>bold</b> text</p><p/><p class="x">styled</p></body>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"body": {"p": ["plain", {"#content": "text", "b": "bold"}, "", {"#content": "styled", "-class": "x"}]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetMixedContentArrayShape(MixedArrayObjects).Encode(root))
+	assert.Equal(`{"body": {"p": [{"#content": "plain"}, {"#content": "text", "b": "bold"}, {"#content": ""}, {"#content": "styled", "-class": "x"}]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetMixedContentArrayShape(MixedArrayObjects).SetMixedContentKey("#text").Encode(root))
+	assert.Equal(`{"body": {"p": [{"#text": "plain"}, {"#text": "text", "b": "bold"}, {"#text": ""}, {"#text": "styled", "-class": "x"}]}}`+"\n", buf.String())
+
+	// Without mixed content, nothing changes
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<body><p>a</p><p><b>b</b></p></body>`)).Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetMixedContentArrayShape(MixedArrayObjects).Encode(root))
+	assert.Equal(`{"body": {"p": ["a", {"b": "b"}]}}`+"\n", buf.String())
+}
+
+// TestEncodeEmptyAttributeAsTrue ensures that empty and bare attributes can be written as true
+func TestEncodeEmptyAttributeAsTrue(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<form><input disabled="" checked="Checked" name="q" value=""/><note title="">x</note></form>`)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"form": {"input": {"-checked": "Checked", "-disabled": "", "-name": "q", "-value": ""}, "note": {"#content": "x", "-title": ""}}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetEmptyAttributeAsTrue(true).Encode(root))
+	assert.Equal(`{"form": {"input": {"-checked": true, "-disabled": true, "-name": "q", "-value": true}, "note": {"#content": "x", "-title": true}}}`+"\n", buf.String())
+
+	// Bare attributes of lenient parsing
+	root = &Node{}
+	dec := NewDecoder(strings.NewReader(`<form><input disabled required name=q></form>`))
+	dec.SetLenient(true)
+	assert.NoError(dec.Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetEmptyAttributeAsTrue(true).Encode(root))
+	assert.Equal(`{"form": {"input": {"-disabled": true, "-name": "q", "-required": true}}}`+"\n", buf.String())
+
+	// Elements are left alone
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a><b/></a>`)).Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetEmptyAttributeAsTrue(true).Encode(root))
+	assert.Equal(`{"a": {"b": ""}}`+"\n", buf.String())
+}
+
+// TestEncodeAttributeGroup ensures that indexed attributes are collected in index order
+func TestEncodeAttributeGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	encode := func(s string, prefixes ...string) string {
+		root := &Node{}
+		assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+		enc := NewEncoder(new(bytes.Buffer))
+		for _, p := range prefixes {
+			enc.SetAttributeGroup(p)
+		}
+		buf := new(bytes.Buffer)
+		enc.Reset(buf)
+		assert.NoError(enc.Encode(root))
+		return buf.String()
+	}
+
+	assert.Equal(`{"s": {"-opt": ["a", "b", "c"], "-x": "1"}}`+"\n", encode(`<s opt1="a" x="1" opt2="b" opt3="c"/>`, "opt"))
+	assert.Equal(`{"s": {"-opt": ["a", "c", "j"]}}`+"\n", encode(`<s opt10="j" opt1="a" opt3="c"/>`, "opt"))
+	assert.Equal(`{"s": {"-opt": ["a"], "-optX": "x", "-opt_2": "y"}}`+"\n", encode(`<s opt1="a" optX="x" opt_2="y"/>`, "opt"))
+	assert.Equal(`{"s": {"-opt": "z", "-opt1": "a", "-opt2": "b"}}`+"\n", encode(`<s opt="z" opt1="a" opt2="b"/>`, "opt"))
+	assert.Equal(`{"s": {"-c": ["x", "y"], "-opt": ["a"], "c": "child"}}`+"\n", encode(`<s c0="x" c1="y" opt1="a"><c>child</c></s>`, "opt", "c"))
+	assert.Equal(`{"s": {"-opt1": "a", "-opt2": "b"}}`+"\n", encode(`<s opt1="a" opt2="b"/>`))
+}
+
+// TestEncodeNormalizeDates ensures that dates in various layouts are written in a single one
+func TestEncodeNormalizeDates(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<log at="15/01/2023"><e>2023-01-15T10:30:00+02:00</e><e>Sun, 15 Jan 2023 10:30:00 GMT</e><e>20230115</e><e>2023-13-45</e><e>soon</e></log>`
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	layouts := []string{time.RFC3339, time.RFC1123, "02/01/2006", "20060102"}
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetNormalizeDates(layouts, time.RFC3339).SetInferTypes(true).SetSortOrder(None).Encode(root))
+	assert.Equal(`{"log": {"-at": "2023-01-15T00:00:00Z", "e": ["2023-01-15T10:30:00+02:00", "2023-01-15T10:30:00Z", `+
+		`"2023-01-15T00:00:00Z", "2023-13-45", "soon"]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetNormalizeDates(layouts, "2006-01-02").SetMongoExtendedJSON(true).Encode(root.Get("log.e[2]")[0]))
+	assert.Equal(`{"$date": "2023-01-15T00:00:00Z"}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetNormalizeDates(nil, time.RFC3339).SetInferTypes(true).Encode(root.Get("log.e[2]")[0]))
+	assert.Equal("20230115\n", buf.String())
+}
+
+// TestEncodeToFile ensures that the file is truncated and written, and that write errors surface
+func TestEncodeToFile(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a><b>1</b></a>`)).Decode(root))
+
+	path := filepath.Join(t.TempDir(), "out.json")
+	assert.NoError(os.WriteFile(path, []byte(strings.Repeat("stale ", 100)), 0o644))
+	assert.NoError(EncodeToFile(path, root, WithInferTypes(true)))
+	data, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(`{"a": {"b": 1}}`+"\n", string(data))
+
+	assert.Error(EncodeToFile(filepath.Join(t.TempDir(), "missing", "out.json"), root))
+
+	if _, err := os.Stat("/dev/full"); err == nil {
+		// The whole document fits in the buffer: the flush fails
+		assert.Error(EncodeToFile("/dev/full", root))
+	}
+}
+
+// TestEncodeRootAttributePolicy ensures that the attributes of an unwrapped root are kept where asked
+func TestEncodeRootAttributePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<doc version="2" lang="en"><item>1</item><item>2</item></doc>`)).Decode(root))
+
+	for _, tc := range []struct {
+		policy RootAttributePolicy
+		want   string
+	}{
+		{RootAttributesPromote, `{"-version": "2", "-lang": "en", "item": ["1", "2"]}`},
+		{RootAttributesDrop, `{"item": ["1", "2"]}`},
+		{RootAttributesNest, `{"_root": {"-version": "2", "-lang": "en"}, "item": ["1", "2"]}`},
+	} {
+		buf := new(bytes.Buffer)
+		assert.NoError(NewEncoder(buf).SetIncludeRoot(false).SetRootAttributePolicy(tc.policy).SetSortOrder(None).Encode(root))
+		assert.Equal(tc.want+"\n", buf.String())
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetIncludeRoot(false).SetSortOrder(None).SetRootKey("data").Encode(root))
+	assert.Equal(`{"data": {"-version": "2", "-lang": "en", "item": ["1", "2"]}}`+"\n", buf.String())
+
+	// Nothing to nest, nor to unwrap
+	root = &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<doc><item>1</item></doc>`)).Decode(root))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetIncludeRoot(false).SetRootAttributePolicy(RootAttributesNest).Encode(root))
+	assert.Equal(`{"item": "1"}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetIncludeRoot(false).Encode(NewElement("item", NewNode("1"), NewNode("2"))))
+	assert.Equal(`{"item": ["1", "2"]}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"doc": {"item": "1"}}`+"\n", buf.String())
+}
+
+// TestEncodeSortScalarArrays ensures that arrays of scalars are sorted by value, numerically when inferred
+func TestEncodeSortScalarArrays(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<r><n>10</n><n>9</n><n>-1.5</n><w>pear</w><w>apple</w><w>Fig</w><m>b</m><m><x>1</x></m><m>a</m></r>`
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).SetSortScalarArrays(true).Encode(root))
+	assert.Equal(`{"r": {"m": ["b", {"x": "1"}, "a"], "n": ["-1.5", "10", "9"], "w": ["Fig", "apple", "pear"]}}`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetSortScalarArrays(true).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"r": {"m": ["b", {"x": 1}, "a"], "n": [-1.5, 9, 10], "w": ["Fig", "apple", "pear"]}}`+"\n", buf.String())
+
+	// Mixed numbers and strings compare as strings, null first
+	root = NewElement("v", NewNode("10"), NewNode("abc"), &Node{Null: true}, NewNode("9"))
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetSortScalarArrays(true).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"v": [null, 10, 9, "abc"]}`+"\n", buf.String())
+	assert.Equal("10", root.Children["v"][0].Data)
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetSortScalarArrays(true).SetInferTypes(true).SetArrayLimit(2).Encode(root))
+	assert.Contains(buf.String(), `"v": [null, 10]`)
+
+	buf.Reset()
+	assert.NoError(NewEncoder(buf).SetInferTypes(true).Encode(root))
+	assert.Equal(`{"v": [10, "abc", null, 9]}`+"\n", buf.String())
+}
@@ -0,0 +1,102 @@
+package xml2json
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// OrderedMap is a JSON object that keeps its keys in order.
+//
+// Unlike map[string]interface{}, it keeps the key order of the converted
+// document when re-marshaled through encoding/json. The tradeoff is that
+// lookups are linear and duplicate keys are not prevented, so it is meant for
+// passing documents along rather than for random access.
+type OrderedMap []MapItem
+
+// MapItem is a key/value pair of an OrderedMap
+type MapItem struct {
+	Key   string
+	Value interface{}
+}
+
+// ToOrderedMap converts the children of root to an OrderedMap, with the same
+// prefixes as the default Encoder. Keys are in document order, that is the
+// order the children were added in, the text of an element coming first;
+// children set directly in Children come last, sorted, and labels without any
+// node are skipped. Leaf values are strings, repeated elements are
+// []interface{} and complex elements are OrderedMaps.
+func ToOrderedMap(root *Node) OrderedMap {
+	m := OrderedMap{}
+	if root == nil {
+		return m
+	}
+
+	if len(root.Data) > 0 {
+		m = append(m, MapItem{Key: contentPrefix + "content", Value: root.Data})
+	}
+
+	for _, label := range root.orderedLabels() {
+		children := root.Children[label]
+		if len(children) == 0 {
+			continue
+		}
+		if len(children) > 1 {
+			arr := make([]interface{}, 0, len(children))
+			for _, ch := range children {
+				arr = append(arr, orderedValue(ch))
+			}
+			m = append(m, MapItem{Key: label, Value: arr})
+		} else {
+			m = append(m, MapItem{Key: label, Value: orderedValue(children[0])})
+		}
+	}
+
+	return m
+}
+
+// orderedValue returns the OrderedMap representation of a single node
+func orderedValue(n *Node) interface{} {
+	if n.Null {
+		return nil
+	}
+	if n.HasChildren() {
+		return ToOrderedMap(n)
+	}
+	return n.Data
+}
+
+// Get returns the value stored under key, and whether it was found
+func (m OrderedMap) Get(key string) (interface{}, bool) {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalJSON implements json.Marshaler, writing the keys in order
+func (m OrderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	for i, item := range m {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(item.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,53 @@
+package xml2json
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOrderedMap ensures that the key order survives encoding/json
+func TestOrderedMap(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<?xml version="1.0" encoding="UTF-8"?>
+  <osm version="0.6">
+   <zeta>z</zeta>
+   <node id="1"/>
+   <node id="2"/>
+   <mixed attr="attribute">content</mixed>
+  </osm>`
+
+	m, err := ConvertToOrderedMap(strings.NewReader(s))
+	assert.NoError(err)
+
+	b, err := json.Marshal(map[string]interface{}{"doc": m})
+	assert.NoError(err)
+	assert.Equal(`{"doc":{"osm":{"-version":"0.6","zeta":"z","node":[{"-id":"1"},{"-id":"2"}],"mixed":{"#content":"content","-attr":"attribute"}}}}`, string(b))
+
+	osm, ok := m.Get("osm")
+	assert.True(ok)
+	zeta, ok := osm.(OrderedMap).Get("zeta")
+	assert.True(ok)
+	assert.Equal("z", zeta)
+
+	_, ok = m.Get("missing")
+	assert.False(ok)
+
+	assert.Len(ToOrderedMap(nil), 0)
+
+	// Children set directly come after the added ones
+	n := NewElement("b", NewNode("1"))
+	n.AddChild("a", NewNode("2"))
+	n.Children["d"] = Nodes{NewNode("3")}
+	n.Children["c"] = Nodes{NewNode("4")}
+	b, err = json.Marshal(ToOrderedMap(n))
+	assert.NoError(err)
+	assert.Equal(`{"b":"1","a":"2","c":"4","d":"3"}`, string(b))
+
+	// Labels without nodes are skipped
+	m = ToOrderedMap(&Node{Children: map[string]Nodes{"a": {}, "b": {NewNode("1")}}})
+	assert.Equal(OrderedMap{{Key: "b", Value: "1"}}, m)
+}
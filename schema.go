@@ -0,0 +1,92 @@
+package xml2json
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// xsdNamespace is the namespace of XML Schema documents
+const xsdNamespace = "http://www.w3.org/2001/XMLSchema"
+
+// repeatableElements returns the names of the elements declared in the XSD
+// read from r which can occur more than once: those with maxOccurs above 1 or
+// "unbounded", and those of a sequence or choice which can repeat. Names are
+// local, without namespace prefix. The schema is not validated, and neither
+// imports, named types, group references nor type derivation are followed.
+func repeatableElements(r io.Reader) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+
+	// repeats holds, for each open element of the schema, whether the
+	// elements declared within it can repeat because of a compositor
+	repeats := []bool{false}
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			inherited := repeats[len(repeats)-1]
+			if t.Name.Space != xsdNamespace {
+				repeats = append(repeats, inherited)
+				break
+			}
+			switch t.Name.Local {
+			case "element":
+				name := xsdAttr(t, "name")
+				if name == "" {
+					name = xsdAttr(t, "ref")
+				}
+				if i := strings.IndexByte(name, ':'); i >= 0 {
+					name = name[i+1:]
+				}
+				if name != "" && !seen[name] && (inherited || maxOccursAboveOne(t)) {
+					seen[name] = true
+					names = append(names, name)
+				}
+				// Compositors of the parent do not apply to the content
+				repeats = append(repeats, false)
+			case "sequence", "choice", "all", "group":
+				repeats = append(repeats, inherited || maxOccursAboveOne(t))
+			default:
+				repeats = append(repeats, inherited)
+			}
+		case xml.EndElement:
+			if len(repeats) > 1 {
+				repeats = repeats[:len(repeats)-1]
+			}
+		}
+	}
+}
+
+// xsdAttr returns the value of the attribute name of se, "" if it has none
+func xsdAttr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// maxOccursAboveOne returns whether the maxOccurs of se allows more than one
+// occurrence
+func maxOccursAboveOne(se xml.StartElement) bool {
+	switch max := xsdAttr(se, "maxOccurs"); max {
+	case "":
+		return false
+	case "unbounded":
+		return true
+	default:
+		n, err := strconv.Atoi(max)
+		return err == nil && n > 1
+	}
+}
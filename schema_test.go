@@ -0,0 +1,61 @@
+package xml2json
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `<?xml version="1.0"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:element name="library">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="name" type="xs:string"/>
+        <xs:element ref="book" maxOccurs="unbounded"/>
+        <xs:sequence maxOccurs="3">
+          <xs:element name="note" type="xs:string"/>
+        </xs:sequence>
+      </xs:sequence>
+    </xs:complexType>
+  </xs:element>
+  <xs:element name="book">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="title" type="xs:string"/>
+        <xs:element name="author" type="xs:string" maxOccurs="5"/>
+        <xs:element name="isbn" type="xs:string" maxOccurs="1"/>
+      </xs:sequence>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`
+
+// TestRepeatableElements ensures that maxOccurs declarations are extracted
+func TestRepeatableElements(t *testing.T) {
+	assert := assert.New(t)
+
+	names, err := repeatableElements(strings.NewReader(testSchema))
+	assert.NoError(err)
+	assert.Equal([]string{"book", "note", "author"}, names)
+
+	_, err = repeatableElements(strings.NewReader(`<xs:schema`))
+	assert.Error(err)
+}
+
+// TestEncodeSchema ensures that repeatable elements are arrays even when they occur once
+func TestEncodeSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<library><name>City</name><book><title>Go</title><author>Alan</author><isbn>1</isbn></book><note>n</note></library>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	assert.NoError(enc.SetSchema(strings.NewReader(testSchema)))
+	assert.NoError(enc.Encode(root))
+	assert.Equal(`{"library": {"book": [{"author": ["Alan"], "isbn": "1", "title": "Go"}], "name": "City", "note": ["n"]}}`+"\n", buf.String())
+}
@@ -1,14 +1,63 @@
 package xml2json
 
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 // Node is a data element on a tree
 type Node struct {
 	Children map[string]Nodes
 	Data     string
+	Null     bool // encoded as JSON null, whatever its data and children
+
+	// IsAttribute is set on the nodes decoded from an XML attribute
+	IsAttribute bool
+
+	// Raw is set when Data holds the inner XML of the element, verbatim, see
+	// Decoder.SetRawElements
+	Raw bool
+
+	// Preserved is set on the elements decoded under xml:space="preserve",
+	// whose whitespace is kept as is
+	Preserved bool
+
+	// childOrder holds the label of each child, in the order they were added
+	childOrder []string
 }
 
 // Nodes is a list of nodes
 type Nodes []*Node
 
+// NewNode returns a node holding data, ready for children to be added. The
+// decoder builds the nodes of elements with it, so that hand-made trees behave
+// as decoded ones; only the nodes of attributes, which never have children,
+// are built without it, unless Decoder.DecodeInto reuses an older node.
+func NewNode(data string) *Node {
+	return &Node{
+		Data:       data,
+		Children:   map[string]Nodes{},
+		childOrder: []string{},
+	}
+}
+
+// NewElement returns a new node holding children under label, in the given
+// order, as a repeated element would be decoded: NewElement("book", a, b)
+// encodes as {"book": [a, b]}. Without children, label holds a single empty
+// node, as <label/> would.
+func NewElement(label string, children ...*Node) *Node {
+	n := NewNode("")
+	if len(children) == 0 {
+		children = Nodes{NewNode("")}
+	}
+	for _, c := range children {
+		n.AddChild(label, c)
+	}
+	return n
+}
+
 // AddChild appends a node to the list of children
 func (n *Node) AddChild(s string, c *Node) {
 	// Lazy lazy
@@ -17,6 +66,105 @@ func (n *Node) AddChild(s string, c *Node) {
 	}
 
 	n.Children[s] = append(n.Children[s], c)
+	n.childOrder = append(n.childOrder, s)
+}
+
+// reset clears n for reuse, keeping the storage of its children map
+func (n *Node) reset() {
+	for label := range n.Children {
+		delete(n.Children, label)
+	}
+	n.childOrder = n.childOrder[:0]
+	n.Data = ""
+	n.Null = false
+	n.Raw = false
+	n.Preserved = false
+	n.IsAttribute = false
+}
+
+// recycle appends the descendants of n to free, reset, and resets n
+func (n *Node) recycle(free Nodes) Nodes {
+	for _, children := range n.Children {
+		for _, c := range children {
+			free = c.recycle(free)
+			free = append(free, c)
+		}
+	}
+	n.reset()
+	return free
+}
+
+// orderedLabels returns the labels of the children in the order they were
+// first added. Labels set directly in Children, bypassing AddChild, come last
+// in sorted order.
+func (n *Node) orderedLabels() []string {
+	sl := make([]string, 0, len(n.Children))
+	seen := make(map[string]bool, len(n.Children))
+	for _, label := range n.childOrder {
+		if _, ok := n.Children[label]; ok && !seen[label] {
+			seen[label] = true
+			sl = append(sl, label)
+		}
+	}
+
+	var rest []string
+	for label := range n.Children {
+		if !seen[label] {
+			rest = append(rest, label)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(sl, rest...)
+}
+
+// labeledNode is a child node with its label
+type labeledNode struct {
+	label string
+	n     *Node
+}
+
+// orderedChildren returns the children in the order they were added, which is
+// the document order for decoded nodes. Children set directly in Children,
+// bypassing AddChild, come last in the order of orderedLabels.
+func (n *Node) orderedChildren() []labeledNode {
+	res := make([]labeledNode, 0, len(n.childOrder))
+	next := make(map[string]int, len(n.Children))
+	for _, label := range n.childOrder {
+		if i := next[label]; i < len(n.Children[label]) {
+			res = append(res, labeledNode{label, n.Children[label][i]})
+			next[label] = i + 1
+		}
+	}
+	for _, label := range n.orderedLabels() {
+		for _, c := range n.Children[label][next[label]:] {
+			res = append(res, labeledNode{label, c})
+		}
+	}
+	return res
+}
+
+// KeyValue is a child of a node with its label, see Node.Pairs
+type KeyValue struct {
+	Key   string
+	Value *Node
+}
+
+// Pairs returns the children of n with their labels, one pair per child, in
+// the order they were added: the document order for decoded nodes, repeated
+// labels included. Children set directly in Children come last. The slice is a
+// snapshot: changing it does not change n, and children added later are not
+// in it.
+func (n *Node) Pairs() []KeyValue {
+	if n == nil {
+		return nil
+	}
+	children := n.orderedChildren()
+	pairs := make([]KeyValue, len(children))
+	for i, c := range children {
+		pairs[i] = KeyValue{Key: c.label, Value: c.n}
+	}
+	return pairs
 }
 
 // IsComplex returns whether it is a complex type (has children)
@@ -24,7 +172,119 @@ func (n *Node) IsComplex() bool {
 	return len(n.Children) > 0
 }
 
-// HasChildren returns whether it is a complex type (has children)
+// HasChildren returns whether it is a complex type (has children). Attributes
+// are children too, so an element with only attributes is complex and encodes
+// as an object rather than as a string.
 func (n *Node) HasChildren() bool {
 	return len(n.Children) > 0
 }
+
+// Get returns the nodes found at path, a list of labels separated by dots.
+// Each label may be followed by an index in brackets to select a single node
+// among repeated elements, e.g. "osm.node[1].tag". Without an index, all the
+// nodes with that label are selected. An empty path selects n itself.
+func (n *Node) Get(path string) Nodes {
+	if n == nil {
+		return nil
+	}
+
+	cur := Nodes{n}
+	if path == "" {
+		return cur
+	}
+
+	for _, step := range strings.Split(path, ".") {
+		label, index := step, -1
+		if i := strings.IndexByte(step, '['); i >= 0 && strings.HasSuffix(step, "]") {
+			idx, err := strconv.Atoi(step[i+1 : len(step)-1])
+			if err != nil || idx < 0 {
+				return nil
+			}
+			label, index = step[:i], idx
+		}
+
+		var next Nodes
+		for _, c := range cur {
+			children := c.Children[label]
+			if index < 0 {
+				next = append(next, children...)
+			} else if index < len(children) {
+				next = append(next, children[index])
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		cur = next
+	}
+
+	return cur
+}
+
+// Walk calls fn for n and then for each of its descendants, in pre-order. The
+// children of a node are visited in the order they were added, a repeated
+// label visiting all its nodes in turn. The path given to fn is the list of
+// labels from n, with an index in brackets on repeated elements, so that
+// strings.Join(path, ".") is a Get path selecting that node; n itself has an
+// empty path. The path slice is reused and is only valid during the call.
+//
+// A non-nil error from fn stops the walk and is returned. fn must not add or
+// remove children while walking.
+func (n *Node) Walk(fn func(path []string, n *Node) error) error {
+	if n == nil {
+		return nil
+	}
+	return n.walk(nil, fn)
+}
+
+func (n *Node) walk(path []string, fn func(path []string, n *Node) error) error {
+	if err := fn(path, n); err != nil {
+		return err
+	}
+
+	for _, label := range n.orderedLabels() {
+		children := n.Children[label]
+		for ii, c := range children {
+			step := label
+			if len(children) > 1 {
+				step = label + "[" + strconv.Itoa(ii) + "]"
+			}
+			if err := c.walk(append(path, step), fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// FindAll returns the nodes of the tree under n, n included, for which pred
+// returns true, in the pre-order of Walk: a node comes before its descendants,
+// and the children of a node in the order they were added. Attributes are
+// children too and are given to pred as well, with IsAttribute set.
+func (n *Node) FindAll(pred func(*Node) bool) Nodes {
+	var res Nodes
+	n.Walk(func(_ []string, c *Node) error {
+		if pred(c) {
+			res = append(res, c)
+		}
+		return nil
+	})
+	return res
+}
+
+// errFound stops the walk of Find at the first match
+var errFound = errors.New("found")
+
+// Find returns the first node FindAll would return, or nil if none matches
+func (n *Node) Find(pred func(*Node) bool) *Node {
+	var res *Node
+	n.Walk(func(_ []string, c *Node) error {
+		if pred(c) {
+			res = c
+			return errFound
+		}
+		return nil
+	})
+	return res
+}
@@ -1,6 +1,9 @@
 package xml2json
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,3 +34,154 @@ func TestIsComplex(t *testing.T) {
 	n.Data = "foo"
 	assert.True(n.IsComplex(), "data does not impact IsComplex")
 }
+
+func TestGet(t *testing.T) {
+	assert := assert.New(t)
+
+	n := Node{}
+	a := &Node{}
+	a.AddChild("b", &Node{Data: "1"})
+	a.AddChild("b", &Node{Data: "2"})
+	n.AddChild("a", a)
+	n.AddChild("a", &Node{Data: "3"})
+
+	assert.Len(n.Get(""), 1)
+	assert.Len(n.Get("a"), 2)
+	assert.Equal("3", n.Get("a[1]")[0].Data)
+	assert.Len(n.Get("a.b"), 2)
+	assert.Equal("2", n.Get("a[0].b[1]")[0].Data)
+	assert.Nil(n.Get("a.c"))
+	assert.Nil(n.Get("a[2]"))
+	assert.Nil(n.Get("a[x]"))
+}
+
+func TestOrderedLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	n := Node{}
+	n.AddChild("c", &Node{})
+	n.AddChild("a", &Node{})
+	n.AddChild("c", &Node{})
+	n.Children["b"] = Nodes{&Node{}}
+	assert.Equal([]string{"c", "a", "b"}, n.orderedLabels())
+
+	// Lookups are not affected by the order tracking
+	assert.Len(n.Get("c"), 2)
+}
+
+func TestWalk(t *testing.T) {
+	assert := assert.New(t)
+
+	n := &Node{}
+	a := &Node{}
+	a.AddChild("b", &Node{Data: "1"})
+	a.AddChild("b", &Node{Data: "2"})
+	n.AddChild("a", a)
+	n.AddChild("c", &Node{Data: "3"})
+
+	var paths []string
+	err := n.Walk(func(path []string, c *Node) error {
+		p := strings.Join(path, ".")
+		paths = append(paths, p)
+		assert.Equal(c, n.Get(p)[0])
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"", "a", "a.b[0]", "a.b[1]", "c"}, paths)
+
+	stop := errors.New("stop")
+	paths = nil
+	err = n.Walk(func(path []string, c *Node) error {
+		paths = append(paths, strings.Join(path, "."))
+		if c.Data == "1" {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(stop, err)
+	assert.Equal([]string{"", "a", "a.b[0]"}, paths)
+}
+
+// TestPairs ensures that the children are listed in document order
+func TestPairs(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<a id="1"><b>1</b><c>2</c><b>3</b></a>`)).Decode(root))
+
+	a := root.Get("a")[0]
+	pairs := a.Pairs()
+	var keys, values []string
+	for _, p := range pairs {
+		keys = append(keys, p.Key)
+		values = append(values, p.Value.Data)
+	}
+	assert.Equal([]string{"-id", "b", "c", "b"}, keys)
+	assert.Equal([]string{"1", "1", "2", "3"}, values)
+	assert.Same(a.Children["b"][1], pairs[3].Value)
+
+	// A snapshot
+	pairs[0].Key = "x"
+	a.AddChild("d", &Node{})
+	assert.Len(pairs, 4)
+	assert.Equal("-id", a.Pairs()[0].Key)
+	assert.Len(a.Pairs(), 5)
+
+	var nilNode *Node
+	assert.Nil(nilNode.Pairs())
+	assert.Empty((&Node{Data: "leaf"}).Pairs())
+}
+
+// TestNewElement ensures that hand-made trees encode as decoded ones
+func TestNewElement(t *testing.T) {
+	assert := assert.New(t)
+
+	n := NewNode("text")
+	assert.Equal("text", n.Data)
+	assert.NotNil(n.Children)
+	assert.False(n.HasChildren())
+	n.Children["direct"] = Nodes{NewNode("1")}
+	assert.True(n.HasChildren())
+
+	book := NewNode("")
+	book.AddChild("-id", &Node{Data: "1", IsAttribute: true})
+	book.AddChild("title", NewNode("Go"))
+	root := NewElement("catalog", NewElement("book", book, NewElement("title", NewNode("XML"))), NewElement("empty"))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewEncoder(buf).Encode(root))
+	assert.Equal(`{"catalog": [{"book": [{"-id": "1", "title": "Go"}, {"title": "XML"}]}, {"empty": ""}]}`+"\n", buf.String())
+
+	decoded := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<catalog><book id="1"><title>Go</title></book><book><title>XML</title></book></catalog>`)).Decode(decoded))
+	hand := NewElement("catalog", NewElement("book", book, NewElement("title", NewNode("XML"))))
+	assert.Empty(Diff(decoded, hand))
+}
+
+// TestFindAll ensures that predicates match at any depth, in pre-order
+func TestFindAll(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(`<log type="error"><entry type="info">a</entry><entry type="error">b<detail type="error">c</detail></entry><group><entry type="error">d</entry></group></log>`)).Decode(root))
+
+	isError := func(n *Node) bool {
+		t := n.Children["-type"]
+		return len(t) == 1 && t[0].Data == "error"
+	}
+	found := root.FindAll(isError)
+	if assert.Len(found, 4) {
+		assert.Equal(root.Get("log")[0], found[0])
+		assert.Equal(root.Get("log.entry[1]")[0], found[1])
+		assert.Equal("c", found[2].Data)
+		assert.Equal("d", found[3].Data)
+	}
+	assert.Equal(found[0], root.Find(isError))
+
+	assert.Len(root.FindAll(func(n *Node) bool { return n.IsAttribute }), 5)
+	assert.Empty(root.FindAll(func(n *Node) bool { return n.Data == "none" }))
+	assert.Nil(root.Find(func(n *Node) bool { return n.Data == "none" }))
+
+	var nilNode *Node
+	assert.Nil(nilNode.Find(isError))
+}
@@ -0,0 +1,310 @@
+package xml2json
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidName is returned by XMLEncoder.Encode with the InvalidNameError
+// policy when a label is not a valid XML name
+var ErrInvalidName = errors.New("xml2json: invalid XML name")
+
+// InvalidNamePolicy is what the XMLEncoder does with the labels which are not
+// valid XML names, such as "first name", see XMLEncoder.SetInvalidNamePolicy.
+// A valid name is an NCName, or two separated by a single colon as a namespace
+// prefix, "xlink:href".
+type InvalidNamePolicy int
+
+const (
+	// InvalidNameError makes the encoding fail with ErrInvalidName, nothing
+	// being written. It is the default.
+	InvalidNameError InvalidNamePolicy = iota
+	// InvalidNameSanitize writes the name with each character an NCName
+	// cannot hold, colons beyond the prefix one included, replaced with "_",
+	// and "_" put in front of a name which does not start with a letter or
+	// "_": "first name" gives "first_name", "1st" "_1st", "a:b:c" "a:b_c" and
+	// "" "_".
+	InvalidNameSanitize
+)
+
+// An XMLEncoder writes Node trees as XML to an output stream, the reverse of
+// the Decoder.
+type XMLEncoder struct {
+	w  io.Writer
+	xw xmlWriter
+}
+
+// NewXMLEncoder returns a new XML encoder that writes to w.
+func NewXMLEncoder(w io.Writer) *XMLEncoder {
+	return &XMLEncoder{w: w, xw: xmlWriter{attributePrefix: attrPrefix}}
+}
+
+// SetInvalidNamePolicy sets what Encode does with the element and attribute
+// names which are not valid XML names, see InvalidNamePolicy
+func (enc *XMLEncoder) SetInvalidNamePolicy(p InvalidNamePolicy) *XMLEncoder {
+	enc.xw.namePolicy = p
+	return enc
+}
+
+// SetAttributePrefix sets the prefix of the labels which are written as
+// attributes, "-" by default like the Decoder. Nodes with IsAttribute set are
+// attributes too.
+func (enc *XMLEncoder) SetAttributePrefix(prefix string) *XMLEncoder {
+	enc.xw.attributePrefix = prefix
+	return enc
+}
+
+// SetIndent writes each element on its own line, indented by indent for each
+// level of nesting.
+func (enc *XMLEncoder) SetIndent(indent string) *XMLEncoder {
+	enc.xw.indent = indent
+	return enc
+}
+
+// SetCDATAElements makes the text of the elements with the given names be
+// written as CDATA sections instead of escaped, for text holding markup such
+// as HTML. "]]>" in the text ends the section and starts a new one.
+func (enc *XMLEncoder) SetCDATAElements(names ...string) *XMLEncoder {
+	if enc.xw.cdata == nil {
+		enc.xw.cdata = map[string]bool{}
+	}
+	for _, name := range names {
+		enc.xw.cdata[name] = true
+	}
+	return enc
+}
+
+// Encode writes root as XML to the stream: the children of root are the
+// top-level elements, see Node.XMLString.
+func (enc *XMLEncoder) Encode(root *Node) error {
+	if root == nil {
+		return nil
+	}
+	enc.xw.buf.Reset()
+	enc.xw.err = nil
+	enc.xw.content("", root, 0)
+	if enc.xw.err != nil {
+		return enc.xw.err
+	}
+	_, err := enc.w.Write(enc.xw.buf.Bytes())
+	return err
+}
+
+// xmlWriter writes Node trees back as XML, following the conventions of the
+// Decoder: children whose label starts with the attribute prefix, or which
+// have IsAttribute set, are attributes, and Data is the text of the element.
+type xmlWriter struct {
+	buf             bytes.Buffer
+	attributePrefix string
+	indent          string
+	cdata           map[string]bool
+	namePolicy      InvalidNamePolicy
+	err             error // first invalid name met with InvalidNameError
+}
+
+// XMLString returns n as indented XML, for debugging: it shows how the
+// document was parsed, e.g. which values are attributes. n is taken as the
+// document, its children being the top-level elements; its own text, if any,
+// comes first and its own attributes are left out as they have no element to
+// go on. Null nodes are written as xsi:nil elements, declaring the xsi
+// namespace. The default prefixes of the Decoder are assumed, and invalid
+// names are sanitized, see InvalidNameSanitize.
+func (n *Node) XMLString() string {
+	if n == nil {
+		return ""
+	}
+	w := &xmlWriter{attributePrefix: attrPrefix, indent: "  ", namePolicy: InvalidNameSanitize}
+	w.content("", n, 0)
+	return strings.TrimSuffix(w.buf.String(), "\n")
+}
+
+// isAttribute returns whether c, child of label, is written as an attribute
+func (w *xmlWriter) isAttribute(label string, c *Node) bool {
+	if c.HasChildren() {
+		return false
+	}
+	return c.IsAttribute || (w.attributePrefix != "" && strings.HasPrefix(label, w.attributePrefix))
+}
+
+// newline ends a line when indenting
+func (w *xmlWriter) newline() {
+	if w.indent != "" {
+		w.buf.WriteByte('\n')
+	}
+}
+
+// text writes the text of n, the element name: as is for raw elements, whose
+// text is XML already
+func (w *xmlWriter) text(name string, n *Node) {
+	data := n.Data
+	if n.Raw {
+		w.buf.WriteString(data)
+		return
+	}
+	if !w.cdata[name] {
+		xml.EscapeText(&w.buf, []byte(data))
+		return
+	}
+	w.buf.WriteString("<![CDATA[")
+	w.buf.WriteString(strings.ReplaceAll(data, "]]>", "]]]]><![CDATA[>"))
+	w.buf.WriteString("]]>")
+}
+
+// content writes the text and child elements of n, the element name, each
+// child element on its own line at depth lvl
+func (w *xmlWriter) content(name string, n *Node, lvl int) {
+	if n.Data != "" {
+		w.buf.WriteString(strings.Repeat(w.indent, lvl))
+		w.text(name, n)
+		w.newline()
+	}
+	for _, c := range n.orderedChildren() {
+		if !w.isAttribute(c.label, c.n) {
+			w.element(c.label, c.n, lvl)
+		}
+	}
+}
+
+// element writes n as the element name at depth lvl
+func (w *xmlWriter) element(name string, n *Node, lvl int) {
+	w.buf.WriteString(strings.Repeat(w.indent, lvl))
+	tag := w.name(name)
+	w.buf.WriteString("<" + tag)
+	var elements, xsiDeclared bool
+	for _, c := range n.orderedChildren() {
+		if !w.isAttribute(c.label, c.n) {
+			elements = true
+			continue
+		}
+		name := strings.TrimPrefix(c.label, w.attributePrefix)
+		if isXsiDeclaration(name, c.n) {
+			name, xsiDeclared = "xmlns:xsi", true
+		}
+		w.buf.WriteString(" " + w.name(name) + `="`)
+		xml.EscapeText(&w.buf, []byte(c.n.Data))
+		w.buf.WriteByte('"')
+	}
+
+	switch {
+	case n.Null:
+		if !xsiDeclared {
+			w.buf.WriteString(` xmlns:xsi="` + xsiNamespace + `"`)
+		}
+		w.buf.WriteString(` xsi:nil="true"/>`)
+	case elements:
+		w.buf.WriteString(">")
+		w.newline()
+		w.content(name, n, lvl+1)
+		w.buf.WriteString(strings.Repeat(w.indent, lvl) + "</" + tag + ">")
+	case n.Data != "":
+		w.buf.WriteByte('>')
+		w.text(name, n)
+		w.buf.WriteString("</" + tag + ">")
+	default:
+		w.buf.WriteString("/>")
+	}
+	w.newline()
+}
+
+// isXsiDeclaration returns whether the attribute name holding n declares the
+// xsi namespace: the Decoder labels xmlns:xsi with its local name, xsi
+func isXsiDeclaration(name string, n *Node) bool {
+	return (name == "xsi" || name == "xmlns:xsi") && n.Data == xsiNamespace
+}
+
+// name returns label as written as an element or attribute name, sanitized
+// when it is not a valid one and the policy says so
+func (w *xmlWriter) name(label string) string {
+	if isXMLName(label) {
+		return label
+	}
+	if w.namePolicy == InvalidNameError {
+		if w.err == nil {
+			w.err = fmt.Errorf("%w: %q", ErrInvalidName, label)
+		}
+		return label
+	}
+	return sanitizeXMLName(label)
+}
+
+// isXMLName returns whether s is an NCName, or two separated by a colon
+func isXMLName(s string) bool {
+	prefix, local, ok := strings.Cut(s, ":")
+	if !ok {
+		return isNCName(s)
+	}
+	return isNCName(prefix) && isNCName(local)
+}
+
+// isNCName returns whether s is an XML name without colon
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r == utf8.RuneError || !isNameChar(r) || (i == 0 && !isNameStartChar(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeXMLName returns s with the characters an XML name cannot hold
+// replaced, for InvalidNameSanitize
+func sanitizeXMLName(s string) string {
+	var sb strings.Builder
+	colon := false
+	for i, r := range s {
+		switch {
+		case r == ':' && !colon && i > 0 && i < len(s)-1:
+			colon = true
+			sb.WriteRune(r)
+		case r == utf8.RuneError || !isNameChar(r):
+			sb.WriteByte('_')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	name := sb.String()
+	if r, _ := utf8.DecodeRuneInString(name); name == "" || !isNameStartChar(r) {
+		name = "_" + name
+	}
+	if prefix, local, ok := strings.Cut(name, ":"); ok {
+		// local is not empty, trailing colons being replaced
+		if r, _ := utf8.DecodeRuneInString(local); !isNameStartChar(r) {
+			name = prefix + ":_" + local
+		}
+	}
+	return name
+}
+
+// isNameStartChar returns whether r may start an NCName
+func isNameStartChar(r rune) bool {
+	switch {
+	case 'A' <= r && r <= 'Z', 'a' <= r && r <= 'z', r == '_':
+		return true
+	case 0xC0 <= r && r <= 0xD6, 0xD8 <= r && r <= 0xF6, 0xF8 <= r && r <= 0x2FF,
+		0x370 <= r && r <= 0x37D, 0x37F <= r && r <= 0x1FFF, 0x200C <= r && r <= 0x200D,
+		0x2070 <= r && r <= 0x218F, 0x2C00 <= r && r <= 0x2FEF, 0x3001 <= r && r <= 0xD7FF,
+		0xF900 <= r && r <= 0xFDCF, 0xFDF0 <= r && r <= 0xFFFD, 0x10000 <= r && r <= 0xEFFFF:
+		return true
+	}
+	return false
+}
+
+// isNameChar returns whether r may be in an NCName
+func isNameChar(r rune) bool {
+	switch {
+	case isNameStartChar(r):
+		return true
+	case r == '-', r == '.', '0' <= r && r <= '9', r == 0xB7,
+		0x300 <= r && r <= 0x36F, 0x203F <= r && r <= 0x2040:
+		return true
+	}
+	return false
+}
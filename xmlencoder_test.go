@@ -0,0 +1,140 @@
+package xml2json
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestXMLString ensures that a tree is rendered back as indented XML
+func TestXMLString(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<library name="City &amp; Co"><book id="1"><title>Go</title><author>Alan</author></book><note>a &lt; b</note><book id="2"/></library>`
+
+	root := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(s)).Decode(root))
+	assert.Equal(`<library name="City &amp; Co">
+  <book id="1">
+    <title>Go</title>
+    <author>Alan</author>
+  </book>
+  <note>a &lt; b</note>
+  <book id="2"/>
+</library>`, root.XMLString())
+
+	// Decoding the output gives the same tree
+	again := &Node{}
+	assert.NoError(NewDecoder(strings.NewReader(root.XMLString())).Decode(again))
+	assert.Equal(Compact(root), Compact(again))
+
+	// Nil and leaf nodes
+	var nilNode *Node
+	assert.Equal("", nilNode.XMLString())
+	assert.Equal("1 &gt; 0", (&Node{Data: "1 > 0"}).XMLString())
+
+	built := &Node{}
+	built.Children = map[string]Nodes{"a": {{Null: true}, {Data: "x"}}}
+	assert.Equal("<a xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xsi:nil=\"true\"/>\n<a>x</a>", built.XMLString())
+
+	// The namespace is declared, so that strict parsers read it back
+	again = &Node{}
+	dec := NewDecoder(strings.NewReader(built.XMLString()))
+	dec.SetRecognizeXsiNil(true)
+	assert.NoError(dec.Decode(again))
+	assert.True(again.Children["a"][0].Null)
+
+	// A decoded declaration is written back once
+	s = `<a xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:nil="true"/>`
+	again = &Node{}
+	dec = NewDecoder(strings.NewReader(s))
+	dec.SetRecognizeXsiNil(true)
+	assert.NoError(dec.Decode(again))
+	assert.Equal(s, again.XMLString())
+}
+
+// TestXMLEncoderRaw ensures that raw elements are written back as XML
+func TestXMLEncoderRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	s := `<page><svg width="10"><g id="a"><text>1 &lt; 2</text></g></svg><title>a &lt; b</title></page>`
+	root := &Node{}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.SetRawElements("svg")
+	assert.NoError(dec.Decode(root))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewXMLEncoder(buf).Encode(root))
+	assert.Equal(s, buf.String())
+}
+
+// TestXMLEncoderCDATA ensures that the text of CDATA elements is not escaped
+func TestXMLEncoderCDATA(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &Node{}
+	post := &Node{}
+	post.AddChild("title", &Node{Data: "a < b"})
+	post.AddChild("body", &Node{Data: "<p>Hi & bye</p>"})
+	post.AddChild("code", &Node{Data: "x[a[1]]>0"})
+	root.AddChild("post", post)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(NewXMLEncoder(buf).SetCDATAElements("body", "code").Encode(root))
+	assert.Equal(`<post><title>a &lt; b</title><body><![CDATA[<p>Hi & bye</p>]]></body><code><![CDATA[x[a[1]]]]><![CDATA[>0]]></code></post>`, buf.String())
+
+	// The text is read back as is
+	var again struct {
+		Body string `xml:"body"`
+		Code string `xml:"code"`
+	}
+	assert.NoError(xml.Unmarshal(buf.Bytes(), &again))
+	assert.Equal("<p>Hi & bye</p>", again.Body)
+	assert.Equal("x[a[1]]>0", again.Code)
+
+	buf.Reset()
+	assert.NoError(NewXMLEncoder(buf).SetIndent("\t").SetCDATAElements("body").Encode(root))
+	assert.Equal("<post>\n\t<title>a &lt; b</title>\n\t<body><![CDATA[<p>Hi & bye</p>]]></body>\n\t<code>x[a[1]]&gt;0</code>\n</post>\n", buf.String())
+}
+
+// TestXMLEncoderInvalidNamePolicy ensures that labels which are not XML names are rejected or sanitized
+func TestXMLEncoderInvalidNamePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	person := &Node{}
+	person.AddChild("-data id", &Node{Data: "7"})
+	person.AddChild("first name", &Node{Data: "Ada"})
+	person.AddChild("1st", &Node{Data: "x"})
+	person.AddChild("xlink:href", &Node{Data: "#a"})
+	person.AddChild("a:b:c", &Node{Data: "y"})
+	person.AddChild(":lead", &Node{Data: "z"})
+	child := &Node{}
+	child.AddChild("ok", &Node{Data: "1"})
+	person.AddChild("x=y", child)
+	root := &Node{}
+	root.AddChild("person", person)
+
+	buf := new(bytes.Buffer)
+	err := NewXMLEncoder(buf).Encode(root)
+	assert.ErrorIs(err, ErrInvalidName)
+	assert.Contains(err.Error(), `"data id"`)
+	assert.Empty(buf.String())
+
+	assert.NoError(NewXMLEncoder(buf).SetInvalidNamePolicy(InvalidNameSanitize).Encode(root))
+	assert.Equal(`<person data_id="7"><first_name>Ada</first_name><_1st>x</_1st><xlink:href>#a</xlink:href>`+
+		`<a:b_c>y</a:b_c><_lead>z</_lead><x_y><ok>1</ok></x_y></person>`, buf.String())
+
+	// Valid names pass by default, non-ASCII letters included
+	buf.Reset()
+	assert.NoError(NewXMLEncoder(buf).Encode(NewElement("café", NewNode("1"))))
+	assert.Equal(`<café>1</café>`, buf.String())
+
+	for name, want := range map[string]string{"": "_", "a:": "a_", "a:1b": "a:_1b", "-x": "_-x", "é.1": "é.1", "a\xffb": "a_b"} {
+		assert.Equal(want, sanitizeXMLName(name), name)
+		assert.True(isXMLName(sanitizeXMLName(name)), name)
+	}
+	assert.Equal("<first_name>Ada</first_name>", NewElement("first name", NewNode("Ada")).XMLString())
+}